@@ -0,0 +1,246 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/jackc/pgx/v5"
+
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+const (
+	AccountStatusDeactivated = "deactivated"
+	AccountStatusTakendown   = "takendown"
+	AccountStatusSuspended   = "suspended"
+	AccountStatusDeleted     = "deleted"
+)
+
+// tables whose rows are owned by a repo through their "author" column
+var authoredTables = []string{
+	"posts",
+	"likes",
+	"reposts",
+	"follows",
+	"blocks",
+	"lists",
+	"list_items",
+	"list_blocks",
+	"feed_generators",
+	"thread_gates",
+	"post_gates",
+	"starter_packs",
+	"records",
+	"post_searches",
+}
+
+// HandleAccountEvent processes an #account event. Inactive accounts are hidden
+// from hydrated views, deleted accounts have all of their data purged.
+func (b *PostgresBackend) HandleAccountEvent(ctx context.Context, evt *atproto.SyncSubscribeRepos_Account) error {
+	rid, err := b.lookupRepoID(ctx, evt.Did)
+	if err != nil {
+		return err
+	}
+
+	// we have never seen this account, nothing to hide or purge
+	if rid == 0 {
+		return nil
+	}
+
+	if evt.Active {
+		return b.setAccountActive(ctx, rid, evt.Did)
+	}
+
+	status := AccountStatusDeactivated
+	if evt.Status != nil && *evt.Status != "" {
+		status = *evt.Status
+	}
+
+	if status == AccountStatusDeleted {
+		if err := b.purgeRepo(ctx, rid, evt.Did); err != nil {
+			return fmt.Errorf("purging deleted account %s: %w", evt.Did, err)
+		}
+	}
+
+	return b.setAccountInactive(ctx, rid, evt.Did, status)
+}
+
+// AccountIsActive returns false if the account has been deactivated, taken
+// down, suspended or deleted.
+func (b *PostgresBackend) AccountIsActive(did string) bool {
+	b.inactiveLk.Lock()
+	defer b.inactiveLk.Unlock()
+	_, ok := b.inactiveAccounts[did]
+	return !ok
+}
+
+// AccountStatus returns the status of an inactive account, or the empty
+// string for active accounts.
+func (b *PostgresBackend) AccountStatus(did string) string {
+	b.inactiveLk.Lock()
+	defer b.inactiveLk.Unlock()
+	return b.inactiveAccounts[did]
+}
+
+func (b *PostgresBackend) loadAccountStatuses(ctx context.Context) error {
+	rows, err := b.pgx.Query(ctx, "SELECT r.did, s.status FROM account_statuses s JOIN repos r ON r.id = s.repo")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	b.inactiveLk.Lock()
+	defer b.inactiveLk.Unlock()
+	for rows.Next() {
+		var did, status string
+		if err := rows.Scan(&did, &status); err != nil {
+			return err
+		}
+		b.inactiveAccounts[did] = status
+	}
+
+	return rows.Err()
+}
+
+func (b *PostgresBackend) setAccountActive(ctx context.Context, rid uint, did string) error {
+	wasActive := b.AccountIsActive(did)
+
+	if _, err := b.pgx.Exec(ctx, "DELETE FROM account_statuses WHERE repo = $1", rid); err != nil {
+		return err
+	}
+
+	b.inactiveLk.Lock()
+	delete(b.inactiveAccounts, did)
+	b.inactiveLk.Unlock()
+	b.actorChanged(did)
+
+	if !wasActive {
+		if err := b.repairCountsFor(ctx, rid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *PostgresBackend) setAccountInactive(ctx context.Context, rid uint, did, status string) error {
+	wasActive := b.AccountIsActive(did)
+
+	if _, err := b.pgx.Exec(ctx, `INSERT INTO account_statuses (repo, status, updated_at) VALUES ($1, $2, $3)
+ON CONFLICT (repo) DO UPDATE SET status = $2, updated_at = $3`, rid, status, time.Now()); err != nil {
+		return err
+	}
+
+	b.inactiveLk.Lock()
+	b.inactiveAccounts[did] = status
+	b.inactiveLk.Unlock()
+	b.actorChanged(did)
+
+	if wasActive {
+		if err := b.repairCountsFor(ctx, rid); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("account marked inactive", "did", did, "status", status)
+	return nil
+}
+
+// lookupRepoID returns the ID of an already known repo, or zero if we have
+// never seen it. Unlike GetOrCreateRepo it never creates a new row.
+func (b *PostgresBackend) lookupRepoID(ctx context.Context, did string) (uint, error) {
+	var id uint
+	if err := b.pgx.QueryRow(ctx, "SELECT id FROM repos WHERE did = $1", did).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// purgeRepo removes every record we have indexed for the given repo. The repos
+// row itself is kept so that IDs referenced elsewhere stay stable.
+func (b *PostgresBackend) purgeRepo(ctx context.Context, rid uint, did string) error {
+	// counters that include the account's records, to fix up once they're gone
+	countedPosts, countedActors, err := countedBy(ctx, b.pgx, rid)
+	if err != nil {
+		return err
+	}
+
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM post_counts WHERE post IN (SELECT id FROM posts WHERE author = $1)", rid); err != nil {
+		return err
+	}
+
+	for _, tbl := range authoredTables {
+		if _, err := tx.Exec(ctx, "DELETE FROM "+tbl+" WHERE author = $1", rid); err != nil {
+			return fmt.Errorf("purging %s: %w", tbl, err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM profiles WHERE repo = $1", rid); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM actor_searches WHERE repo = $1", rid); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM notifications WHERE author = $1 OR "for" = $1`, rid); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM sync_infos WHERE repo = $1", rid); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM relevant_dids WHERE did = $1", did); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	b.revCache.Remove(rid)
+
+	if err := recomputePostCounts(ctx, b.pgx, countedPosts); err != nil {
+		return err
+	}
+	if err := recomputeActorCounts(ctx, b.pgx, countedActors); err != nil {
+		return err
+	}
+
+	prefix := "at://" + did + "/"
+	for _, k := range b.postInfoCache.Keys() {
+		if strings.HasPrefix(k, prefix) {
+			b.postInfoCache.Remove(k)
+		}
+	}
+	b.actorPurged(did)
+
+	b.rdLk.Lock()
+	for r := range b.relevantDids[did] {
+		if r.Reason == RelevanceSecondDegree {
+			b.secondDegreeCount[r.User]--
+		}
+	}
+	delete(b.relevantDids, did)
+	delete(b.pinnedDids, did)
+	b.rdLk.Unlock()
+
+	slog.Info("purged deleted account", "did", did)
+	return nil
+}
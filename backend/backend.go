@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
@@ -20,6 +21,7 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	. "github.com/whyrusleeping/konbini/models"
 	"github.com/whyrusleeping/market/models"
+	"golang.org/x/time/rate"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
@@ -34,11 +36,24 @@ type PostgresBackend struct {
 
 	client *xrpc.Client
 
+	// mydid is the account the instance was started with, it is always a
+	// local user
 	mydid  string
 	myrepo *models.Repo
 
-	relevantDids map[string]bool
+	users localUsers
+
+	relevantDids map[string]map[RelevanceReason]bool
 	rdLk         sync.Mutex
+	pinnedDids   map[string]bool
+	relChanges   []relevanceChange
+	relCfg       RelevanceConfig
+
+	// number of DIDs with the second-degree reason, by local user
+	secondDegreeCount map[string]int
+
+	inactiveAccounts map[string]string
+	inactiveLk       sync.Mutex
 
 	revCache *lru.TwoQueueCache[uint, string]
 
@@ -49,7 +64,30 @@ type PostgresBackend struct {
 
 	postInfoCache *lru.TwoQueueCache[string, cachedPostInfo]
 
-	missingRecords chan MissingRecord
+	missing *missingFetcher
+
+	backfill *Backfiller
+
+	// last computed trending topics
+	trending atomic.Pointer[TrendingTags]
+
+	// collections kept in the generic records table
+	recordCollections []string
+
+	handlers   map[string]*RecordHandler
+	handlersLk sync.RWMutex
+
+	listeners   []RecordListener
+	listenersLk sync.RWMutex
+
+	pdsLimiters map[string]*rate.Limiter
+	pdsRate     rate.Limit
+	pdsLimLk    sync.Mutex
+
+	// when we last force-refreshed a DID document to retry a failed
+	// signature check
+	sigRefreshes *lru.TwoQueueCache[string, time.Time]
+	sigRefreshLk sync.Mutex
 }
 
 type cachedPostInfo struct {
@@ -63,21 +101,36 @@ func NewPostgresBackend(mydid string, db *gorm.DB, pgx *pgxpool.Pool, client *xr
 	pc, _ := lru.New2Q[string, cachedPostInfo](1_000_000)
 	revc, _ := lru.New2Q[uint, string](1_000_000)
 	dbic, _ := lru.New2Q[uint, string](1_000_000)
+	src, _ := lru.New2Q[string, time.Time](100_000)
 
 	b := &PostgresBackend{
-		client:        client,
-		mydid:         mydid,
-		db:            db,
-		pgx:           pgx,
-		relevantDids:  make(map[string]bool),
-		repoCache:     rc,
-		postInfoCache: pc,
-		revCache:      revc,
-		didByIDCache:  dbic,
-		dir:           dir,
-
-		missingRecords: make(chan MissingRecord, 1000),
-	}
+		client:            client,
+		mydid:             mydid,
+		db:                db,
+		pgx:               pgx,
+		relevantDids:      make(map[string]map[RelevanceReason]bool),
+		pinnedDids:        make(map[string]bool),
+		secondDegreeCount: make(map[string]int),
+		inactiveAccounts:  make(map[string]string),
+		repoCache:         rc,
+		postInfoCache:     pc,
+		revCache:          revc,
+		didByIDCache:      dbic,
+		dir:               dir,
+
+		handlers: make(map[string]*RecordHandler),
+
+		pdsLimiters: make(map[string]*rate.Limiter),
+		pdsRate:     rate.Inf,
+
+		sigRefreshes: src,
+
+		users: localUsers{
+			byDid:  make(map[string]*LocalUser),
+			byRepo: make(map[uint]*LocalUser),
+		},
+	}
+	b.missing = newMissingFetcher(b)
 
 	r, err := b.GetOrCreateRepo(context.TODO(), mydid)
 	if err != nil {
@@ -86,10 +139,66 @@ func NewPostgresBackend(mydid string, db *gorm.DB, pgx *pgxpool.Pool, client *xr
 
 	b.myrepo = r
 
-	go b.missingRecordFetcher()
+	if err := b.loadLocalUsers(context.TODO()); err != nil {
+		return nil, fmt.Errorf("failed to load local users: %w", err)
+	}
+
+	// graph derived relevance written before we tracked it per user belongs
+	// to the account we were started with
+	if err := b.db.Exec("UPDATE relevant_dids SET local_user = ? WHERE local_user = '' AND reason IN ?", mydid, []string{RelevanceSelf, RelevanceFollow, RelevanceSecondDegree}).Error; err != nil {
+		return nil, fmt.Errorf("failed to migrate relevant dids: %w", err)
+	}
+
+	if _, _, err := b.registerLocalUser(context.TODO(), mydid); err != nil {
+		return nil, err
+	}
+
+	if err := b.loadAccountStatuses(context.TODO()); err != nil {
+		return nil, fmt.Errorf("failed to load account statuses: %w", err)
+	}
+
+	b.missing.start(context.Background())
+
 	return b, nil
 }
 
+// AddRecordListener registers a listener to be told about changes to indexed
+// records and accounts.
+func (b *PostgresBackend) AddRecordListener(l RecordListener) {
+	b.listenersLk.Lock()
+	defer b.listenersLk.Unlock()
+
+	b.listeners = append(b.listeners, l)
+}
+
+func (b *PostgresBackend) recordChanged(did, col, rkey string) {
+	b.listenersLk.RLock()
+	defer b.listenersLk.RUnlock()
+
+	uri := "at://" + did + "/" + col + "/" + rkey
+	for _, l := range b.listeners {
+		l.RecordChanged(uri)
+	}
+}
+
+func (b *PostgresBackend) actorChanged(did string) {
+	b.listenersLk.RLock()
+	defer b.listenersLk.RUnlock()
+
+	for _, l := range b.listeners {
+		l.ActorChanged(did)
+	}
+}
+
+func (b *PostgresBackend) actorPurged(did string) {
+	b.listenersLk.RLock()
+	defer b.listenersLk.RUnlock()
+
+	for _, l := range b.listeners {
+		l.ActorPurged(did)
+	}
+}
+
 // TrackMissingRecord implements the RecordTracker interface
 func (b *PostgresBackend) TrackMissingRecord(identifier string, wait bool) {
 	mr := MissingRecord{
@@ -182,7 +291,8 @@ func (b *PostgresBackend) GetOrCreateList(ctx context.Context, uri string) (*Lis
 		return nil, err
 	}
 
-	// TODO: needs upsert treatment when we actually find the list
+	// this may only be a placeholder, HandleCreateList fills it in when
+	// the list record itself shows up
 	var list List
 	if err := b.db.FirstOrCreate(&list, map[string]any{
 		"author": r.ID,
@@ -346,16 +456,11 @@ func (b *PostgresBackend) revForRepo(rr *Repo) (string, error) {
 	return rev, nil
 }
 
-func (b *PostgresBackend) AddRelevantDid(did string) {
-	b.rdLk.Lock()
-	defer b.rdLk.Unlock()
-	b.relevantDids[did] = true
-}
-
 func (b *PostgresBackend) DidIsRelevant(did string) bool {
 	b.rdLk.Lock()
 	defer b.rdLk.Unlock()
-	return b.relevantDids[did]
+	_, ok := b.relevantDids[did]
+	return ok
 }
 
 func (b *PostgresBackend) anyRelevantIdents(idents ...string) bool {
@@ -430,29 +535,27 @@ func (b *PostgresBackend) checkPostExists(ctx context.Context, repo *Repo, rkey
 	return false, nil
 }
 
-func (b *PostgresBackend) LoadRelevantDids() error {
-	ctx := context.TODO()
-
-	if err := b.ensureFollowsScraped(ctx, b.mydid); err != nil {
-		return fmt.Errorf("failed to scrape follows: %w", err)
+// LoadRelevantDids loads the persisted relevant set, brings it up to date with
+// the follow graphs of our local users and keeps it updated in the background
+// according to the given policy.
+func (b *PostgresBackend) LoadRelevantDids(ctx context.Context, cfg RelevanceConfig) error {
+	for _, u := range b.LocalUsers() {
+		if err := b.ensureFollowsScraped(ctx, u.Did); err != nil {
+			return fmt.Errorf("failed to scrape follows for %s: %w", u.Did, err)
+		}
 	}
 
-	r, err := b.GetOrCreateRepo(ctx, b.mydid)
-	if err != nil {
-		return err
-	}
+	b.relCfg = cfg
 
-	var dids []string
-	if err := b.db.Raw("select did from follows left join repos on follows.subject = repos.id where follows.author = ?", r.ID).Scan(&dids).Error; err != nil {
-		return err
+	if err := b.loadRelevantDidsTable(ctx); err != nil {
+		return fmt.Errorf("failed to load relevant dids table: %w", err)
 	}
 
-	b.relevantDids[b.mydid] = true
-	for _, d := range dids {
-		fmt.Println("adding did: ", d)
-		b.relevantDids[d] = true
+	if err := b.recomputeRelevance(ctx); err != nil {
+		return err
 	}
 
+	go b.runRelevanceRecompute(ctx)
 	return nil
 }
 
@@ -460,6 +563,9 @@ type SyncInfo struct {
 	Repo          uint `gorm:"index"`
 	FollowsSynced bool
 	Rev           string
+
+	// Data is the MST root CID of the commit at Rev
+	Data string
 }
 
 func (b *PostgresBackend) ensureFollowsScraped(ctx context.Context, user string) error {
@@ -486,10 +592,21 @@ func (b *PostgresBackend) ensureFollowsScraped(ctx context.Context, user string)
 		return nil
 	}
 
+	// follows are public, so we read them straight from the user's PDS
+	// rather than needing a session for every local user
+	ident, err := b.dir.LookupDID(ctx, syntax.DID(user))
+	if err != nil {
+		return err
+	}
+
+	c := &xrpc.Client{
+		Host: ident.PDSEndpoint(),
+	}
+
 	var follows []Follow
 	var cursor string
 	for {
-		resp, err := atproto.RepoListRecords(ctx, b.client, "app.bsky.graph.follow", cursor, 100, b.mydid, false)
+		resp, err := atproto.RepoListRecords(ctx, c, "app.bsky.graph.follow", cursor, 100, user, false)
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,315 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+const (
+	BackfillStatePending   = "pending"
+	BackfillStateRunning   = "running"
+	BackfillStateComplete  = "complete"
+	BackfillStateFailed    = "failed"
+	BackfillStateCancelled = "cancelled"
+)
+
+var backfillJobsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "backfill_jobs",
+	Help: "Number of backfill jobs finished, by final state",
+}, []string{"state"})
+
+var backfillRecordsCounter = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "backfill_records",
+	Help: "Number of records indexed by backfill jobs",
+})
+
+type BackfillConfig struct {
+	// Workers is the number of repos fetched concurrently
+	Workers int
+
+	// PDSRate is the number of repo fetches per second allowed against a
+	// single PDS
+	PDSRate float64
+
+	// MaxAttempts is the number of times a job is tried before it is marked
+	// as failed
+	MaxAttempts int
+}
+
+// Backfiller runs backfill jobs stored in the backfill_jobs table.
+type Backfiller struct {
+	b   *PostgresBackend
+	cfg BackfillConfig
+
+	wake chan struct{}
+
+	cancels map[uint]context.CancelFunc
+	cancLk  sync.Mutex
+}
+
+// StartBackfill starts the backfill workers. Jobs left running by a previous
+// process are resumed, and if no job has ever been created every DID in the
+// relevant set is enqueued.
+func (b *PostgresBackend) StartBackfill(ctx context.Context, cfg BackfillConfig) error {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+
+	b.setPDSRate(cfg.PDSRate)
+
+	bf := &Backfiller{
+		b:       b,
+		cfg:     cfg,
+		wake:    make(chan struct{}, 1),
+		cancels: make(map[uint]context.CancelFunc),
+	}
+
+	if _, err := b.pgx.Exec(ctx, "UPDATE backfill_jobs SET state = $1, updated_at = NOW() WHERE state = $2", BackfillStatePending, BackfillStateRunning); err != nil {
+		return fmt.Errorf("failed to reset running backfill jobs: %w", err)
+	}
+
+	var count int64
+	if err := b.pgx.QueryRow(ctx, "SELECT count(*) FROM backfill_jobs").Scan(&count); err != nil {
+		return err
+	}
+
+	b.backfill = bf
+
+	if count == 0 {
+		// a single statement, so a crash part way through can't leave us
+		// with a partial set of jobs that looks like a finished first run
+		dids := b.GetRelevantDids()
+		slog.Info("no backfill jobs found, backfilling relevant set", "count", len(dids))
+		if _, err := b.pgx.Exec(ctx, `INSERT INTO backfill_jobs (did, state, reason, attempts, records, bytes, added, removed, rev, error, next_attempt, created_at, updated_at)
+SELECT did, $2, 'initial', 0, 0, 0, 0, 0, '', '', NOW(), NOW(), NOW() FROM unnest($1::text[]) AS did
+ON CONFLICT (did) DO NOTHING`, dids, BackfillStatePending); err != nil {
+			return fmt.Errorf("failed to enqueue initial backfill: %w", err)
+		}
+	}
+
+	for i := 0; i < cfg.Workers; i++ {
+		go bf.worker(ctx)
+	}
+
+	return nil
+}
+
+// EnqueueBackfill schedules a full fetch of the given repo. If a job for the
+// DID already exists and is not currently queued or running it is restarted.
+func (b *PostgresBackend) EnqueueBackfill(ctx context.Context, did, reason string) (*BackfillJob, error) {
+	if b.backfill == nil {
+		return nil, fmt.Errorf("backfill is not running")
+	}
+
+	now := time.Now()
+	job, err := b.scanBackfillJob(b.pgx.QueryRow(ctx, `INSERT INTO backfill_jobs (did, state, reason, attempts, records, bytes, added, removed, rev, error, next_attempt, created_at, updated_at)
+VALUES ($1, $2, $3, 0, 0, 0, 0, 0, '', '', $4, $4, $4)
+ON CONFLICT (did) DO UPDATE SET state = $2, reason = $3, attempts = 0, records = 0, bytes = 0, added = 0, removed = 0, error = '', next_attempt = $4, updated_at = $4
+WHERE backfill_jobs.state NOT IN ($5, $6)
+RETURNING `+backfillJobColumns, did, BackfillStatePending, reason, now, BackfillStatePending, BackfillStateRunning))
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+
+		// already queued or running, hand back the existing job
+		return b.GetBackfillJobByDid(ctx, did)
+	}
+
+	b.backfill.notify()
+	return job, nil
+}
+
+// CancelBackfill stops a pending or running job.
+func (b *PostgresBackend) CancelBackfill(ctx context.Context, id uint) error {
+	res, err := b.pgx.Exec(ctx, "UPDATE backfill_jobs SET state = $1, finished_at = NOW(), updated_at = NOW() WHERE id = $2 AND state IN ($3, $4)", BackfillStateCancelled, id, BackfillStatePending, BackfillStateRunning)
+	if err != nil {
+		return err
+	}
+
+	if res.RowsAffected() == 0 {
+		return fmt.Errorf("no pending or running backfill job with id %d", id)
+	}
+
+	if b.backfill != nil {
+		b.backfill.cancLk.Lock()
+		cancel, ok := b.backfill.cancels[id]
+		b.backfill.cancLk.Unlock()
+		if ok {
+			cancel()
+		}
+	}
+
+	return nil
+}
+
+// ListBackfillJobs returns the most recently updated jobs, optionally
+// filtered by state.
+func (b *PostgresBackend) ListBackfillJobs(ctx context.Context, state string, limit int) ([]BackfillJob, error) {
+	q := b.db.Order("updated_at DESC").Limit(limit)
+	if state != "" {
+		q = q.Where("state = ?", state)
+	}
+
+	var jobs []BackfillJob
+	if err := q.Find(&jobs).Error; err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+func (b *PostgresBackend) GetBackfillJobByDid(ctx context.Context, did string) (*BackfillJob, error) {
+	return b.scanBackfillJob(b.pgx.QueryRow(ctx, "SELECT "+backfillJobColumns+" FROM backfill_jobs WHERE did = $1", did))
+}
+
+const backfillJobColumns = "id, did, state, reason, attempts, records, bytes, added, removed, rev, error, next_attempt, started_at, finished_at, created_at, updated_at"
+
+func (b *PostgresBackend) scanBackfillJob(row pgx.Row) (*BackfillJob, error) {
+	var j BackfillJob
+	if err := row.Scan(&j.ID, &j.Did, &j.State, &j.Reason, &j.Attempts, &j.Records, &j.Bytes, &j.Added, &j.Removed, &j.Rev, &j.Error, &j.NextAttempt, &j.StartedAt, &j.FinishedAt, &j.CreatedAt, &j.UpdatedAt); err != nil {
+		return nil, err
+	}
+
+	return &j, nil
+}
+
+func (bf *Backfiller) notify() {
+	select {
+	case bf.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (bf *Backfiller) worker(ctx context.Context) {
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	for {
+		job, err := bf.claimJob(ctx)
+		if err != nil {
+			slog.Error("failed to claim backfill job", "error", err)
+		}
+
+		if job != nil {
+			bf.runJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-bf.wake:
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (bf *Backfiller) claimJob(ctx context.Context) (*BackfillJob, error) {
+	job, err := bf.b.scanBackfillJob(bf.b.pgx.QueryRow(ctx, `UPDATE backfill_jobs SET state = $1, attempts = attempts + 1, started_at = NOW(), updated_at = NOW()
+WHERE id = (
+	SELECT id FROM backfill_jobs
+	WHERE state = $2 AND next_attempt <= NOW()
+	ORDER BY id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING `+backfillJobColumns, BackfillStateRunning, BackfillStatePending))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (bf *Backfiller) runJob(ctx context.Context, job *BackfillJob) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	bf.cancLk.Lock()
+	bf.cancels[job.ID] = cancel
+	bf.cancLk.Unlock()
+
+	defer func() {
+		bf.cancLk.Lock()
+		delete(bf.cancels, job.ID)
+		bf.cancLk.Unlock()
+	}()
+
+	slog.Info("starting backfill", "did", job.Did, "attempt", job.Attempts)
+
+	var lastReported int64
+	stats, err := bf.b.syncRepo(ctx, job.Did, func(st syncStats) {
+		backfillRecordsCounter.Add(float64(st.Records - lastReported))
+		lastReported = st.Records
+
+		if _, err := bf.b.pgx.Exec(ctx, "UPDATE backfill_jobs SET records = $1, bytes = $2, updated_at = NOW() WHERE id = $3", st.Records, st.Bytes, job.ID); err != nil {
+			slog.Warn("failed to update backfill progress", "did", job.Did, "error", err)
+		}
+	})
+
+	// use a fresh context, the job context is cancelled on exit
+	dbctx := context.Background()
+
+	if err == nil {
+		backfillRecordsCounter.Add(float64(stats.Records - lastReported))
+		if _, err := bf.b.pgx.Exec(dbctx, "UPDATE backfill_jobs SET state = $1, records = $2, bytes = $3, added = $4, removed = $5, rev = $6, error = '', finished_at = NOW(), updated_at = NOW() WHERE id = $7 AND state = $8",
+			BackfillStateComplete, stats.Records, stats.Bytes, stats.Added, stats.Removed, stats.Rev, job.ID, BackfillStateRunning); err != nil {
+			slog.Error("failed to mark backfill complete", "did", job.Did, "error", err)
+		}
+		backfillJobsCounter.WithLabelValues(BackfillStateComplete).Inc()
+		slog.Info("backfill complete", "did", job.Did, "records", stats.Records, "bytes", stats.Bytes, "added", stats.Added, "removed", stats.Removed)
+		return
+	}
+
+	if ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		// CancelBackfill already updated the row
+		backfillJobsCounter.WithLabelValues(BackfillStateCancelled).Inc()
+		slog.Info("backfill cancelled", "did", job.Did)
+		return
+	}
+
+	if job.Attempts >= bf.cfg.MaxAttempts {
+		if _, err := bf.b.pgx.Exec(dbctx, "UPDATE backfill_jobs SET state = $1, error = $2, finished_at = NOW(), updated_at = NOW() WHERE id = $3 AND state = $4",
+			BackfillStateFailed, err.Error(), job.ID, BackfillStateRunning); err != nil {
+			slog.Error("failed to mark backfill failed", "did", job.Did, "error", err)
+		}
+		backfillJobsCounter.WithLabelValues(BackfillStateFailed).Inc()
+		slog.Warn("backfill failed", "did", job.Did, "attempts", job.Attempts, "error", err)
+		return
+	}
+
+	next := time.Now().Add(backfillRetryDelay(job.Attempts))
+	if _, err := bf.b.pgx.Exec(dbctx, "UPDATE backfill_jobs SET state = $1, error = $2, next_attempt = $3, updated_at = NOW() WHERE id = $4 AND state = $5",
+		BackfillStatePending, err.Error(), next, job.ID, BackfillStateRunning); err != nil {
+		slog.Error("failed to requeue backfill", "did", job.Did, "error", err)
+	}
+	slog.Warn("backfill attempt failed, will retry", "did", job.Did, "attempt", job.Attempts, "next", next, "error", err)
+}
+
+func backfillRetryDelay(attempt int) time.Duration {
+	d := time.Second * 30
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
@@ -0,0 +1,262 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+// Engagement counters live in post_counts and actor_counts so hydration
+// doesn't have to COUNT(*) likes and followers on every view. The event
+// handlers adjust them in the same transaction as the record they index.
+// Records from inactive accounts aren't counted, the same as the views
+// that used to count them on the fly, so when an account changes status
+// the counters it contributed to are recomputed.
+
+// bumpPostCount adds delta to one of a post's counters. Counters never go
+// below zero, a delete for something we counted before the counters existed
+// would otherwise leave them negative until the next repair.
+func bumpPostCount(ctx context.Context, tx pgx.Tx, post uint, col string, delta int) error {
+	if post == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO post_counts (post, %[1]s) VALUES ($1, GREATEST($2, 0))
+ON CONFLICT (post) DO UPDATE SET %[1]s = GREATEST(post_counts.%[1]s + $2, 0)`, col), post, delta); err != nil {
+		return fmt.Errorf("updating %s count: %w", col, err)
+	}
+
+	return nil
+}
+
+// bumpActorCount adds delta to one of an account's counters.
+func bumpActorCount(ctx context.Context, tx pgx.Tx, repo uint, col string, delta int) error {
+	if repo == 0 {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO actor_counts (repo, %[1]s) VALUES ($1, GREATEST($2, 0))
+ON CONFLICT (repo) DO UPDATE SET %[1]s = GREATEST(actor_counts.%[1]s + $2, 0)`, col), repo, delta); err != nil {
+		return fmt.Errorf("updating %s count: %w", col, err)
+	}
+
+	return nil
+}
+
+// updatePostCounts adjusts the counters a post contributes to after it has
+// been written. prev holds the reply and quote targets of the version it
+// replaced, with NotFound set if there wasn't an indexed version before.
+func (b *PostgresBackend) updatePostCounts(ctx context.Context, tx pgx.Tx, repo *Repo, prev, p *Post) error {
+	prevReply, prevQuote := prev.ReplyTo, prev.Reposting
+	if prev.NotFound {
+		if err := bumpActorCount(ctx, tx, p.Author, "posts", 1); err != nil {
+			return err
+		}
+		prevReply, prevQuote = 0, 0
+	}
+
+	if !b.AccountIsActive(repo.Did) {
+		return nil
+	}
+
+	if prevReply != p.ReplyTo {
+		if err := bumpPostCount(ctx, tx, prevReply, "replies", -1); err != nil {
+			return err
+		}
+		if err := bumpPostCount(ctx, tx, p.ReplyTo, "replies", 1); err != nil {
+			return err
+		}
+	}
+
+	if prevQuote != p.Reposting {
+		if err := bumpPostCount(ctx, tx, prevQuote, "quotes", -1); err != nil {
+			return err
+		}
+		if err := bumpPostCount(ctx, tx, p.Reposting, "quotes", 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removePostCounts takes a deleted post out of the counters it contributed
+// to.
+func (b *PostgresBackend) removePostCounts(ctx context.Context, tx pgx.Tx, repo *Repo, p *Post) error {
+	if err := bumpActorCount(ctx, tx, p.Author, "posts", -1); err != nil {
+		return err
+	}
+
+	if !b.AccountIsActive(repo.Did) {
+		return nil
+	}
+
+	if err := bumpPostCount(ctx, tx, p.ReplyTo, "replies", -1); err != nil {
+		return err
+	}
+
+	return bumpPostCount(ctx, tx, p.Reposting, "quotes", -1)
+}
+
+const recomputePostCountsQuery = `
+INSERT INTO post_counts (post, likes, reposts, replies, quotes)
+SELECT p.id,
+	(SELECT count(*) FROM likes l WHERE l.subject = p.id
+		AND NOT EXISTS (SELECT 1 FROM account_statuses s WHERE s.repo = l.author)),
+	(SELECT count(*) FROM reposts rp WHERE rp.subject = p.id
+		AND NOT EXISTS (SELECT 1 FROM account_statuses s WHERE s.repo = rp.author)),
+	(SELECT count(*) FROM posts r WHERE r.reply_to = p.id AND NOT r.not_found
+		AND NOT EXISTS (SELECT 1 FROM account_statuses s WHERE s.repo = r.author)),
+	(SELECT count(*) FROM posts q WHERE q.reposting = p.id AND NOT q.not_found
+		AND NOT EXISTS (SELECT 1 FROM account_statuses s WHERE s.repo = q.author))
+FROM posts p
+WHERE %s
+ON CONFLICT (post) DO UPDATE SET
+	likes = EXCLUDED.likes,
+	reposts = EXCLUDED.reposts,
+	replies = EXCLUDED.replies,
+	quotes = EXCLUDED.quotes
+`
+
+const recomputeActorCountsQuery = `
+INSERT INTO actor_counts (repo, follows, followers, posts)
+SELECT r.id,
+	(SELECT count(*) FROM follows f WHERE f.author = r.id
+		AND NOT EXISTS (SELECT 1 FROM account_statuses s WHERE s.repo = f.subject)),
+	(SELECT count(*) FROM follows f WHERE f.subject = r.id
+		AND NOT EXISTS (SELECT 1 FROM account_statuses s WHERE s.repo = f.author)),
+	(SELECT count(*) FROM posts p WHERE p.author = r.id AND NOT p.not_found)
+FROM repos r
+WHERE %s
+ON CONFLICT (repo) DO UPDATE SET
+	follows = EXCLUDED.follows,
+	followers = EXCLUDED.followers,
+	posts = EXCLUDED.posts
+`
+
+func recomputePostCounts(ctx context.Context, db *pgxpool.Pool, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(ctx, fmt.Sprintf(recomputePostCountsQuery, "p.id = ANY($1)"), ids); err != nil {
+		return fmt.Errorf("recomputing post counts: %w", err)
+	}
+
+	return nil
+}
+
+func recomputeActorCounts(ctx context.Context, db *pgxpool.Pool, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := db.Exec(ctx, fmt.Sprintf(recomputeActorCountsQuery, "r.id = ANY($1)"), ids); err != nil {
+		return fmt.Errorf("recomputing actor counts: %w", err)
+	}
+
+	return nil
+}
+
+// countedBy returns the posts and accounts whose counters include records
+// authored by the given repo.
+func countedBy(ctx context.Context, db *pgxpool.Pool, rid uint) ([]int64, []int64, error) {
+	rows, err := db.Query(ctx, `
+SELECT subject FROM likes WHERE author = $1
+UNION SELECT subject FROM reposts WHERE author = $1
+UNION SELECT reply_to FROM posts WHERE author = $1 AND reply_to != 0
+UNION SELECT reposting FROM posts WHERE author = $1 AND reposting != 0`, rid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	posts, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = db.Query(ctx, `
+SELECT subject FROM follows WHERE author = $1
+UNION SELECT author FROM follows WHERE subject = $1
+UNION SELECT $1::bigint`, rid)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	actors, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return posts, actors, nil
+}
+
+// repairCountsFor recomputes the counters the given repo contributes to,
+// after its account status changed.
+func (b *PostgresBackend) repairCountsFor(ctx context.Context, rid uint) error {
+	posts, actors, err := countedBy(ctx, b.pgx, rid)
+	if err != nil {
+		return fmt.Errorf("finding counters for repo %d: %w", rid, err)
+	}
+
+	if err := recomputePostCounts(ctx, b.pgx, posts); err != nil {
+		return err
+	}
+
+	return recomputeActorCounts(ctx, b.pgx, actors)
+}
+
+const repairBatchSize = 10_000
+
+// RepairCounts recomputes every engagement counter from the indexed records.
+// It works through posts and repos in ID ranges so it can run alongside
+// ingest without holding long transactions.
+func RepairCounts(ctx context.Context, pool *pgxpool.Pool) error {
+	for _, t := range []struct {
+		table string
+		query string
+		col   string
+	}{
+		{"posts", recomputePostCountsQuery, "p.id"},
+		{"repos", recomputeActorCountsQuery, "r.id"},
+	} {
+		var maxID int64
+		if err := pool.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM "+t.table).Scan(&maxID); err != nil {
+			return err
+		}
+
+		q := fmt.Sprintf(t.query, t.col+" > $1 AND "+t.col+" <= $2")
+		for start := int64(0); start < maxID; start += repairBatchSize {
+			if _, err := pool.Exec(ctx, q, start, start+repairBatchSize); err != nil {
+				return fmt.Errorf("repairing %s counts at %d: %w", t.table, start, err)
+			}
+		}
+
+		slog.Info("repaired counts", "table", t.table, "max_id", maxID)
+	}
+
+	return nil
+}
+
+// bumpFollowCounts adjusts the follows count of the author and the followers
+// count of the subject for a follow record. Each side only counts if the
+// account on the other side is active.
+func (b *PostgresBackend) bumpFollowCounts(ctx context.Context, tx pgx.Tx, author uint, authorDid string, subject uint, subjectDid string, delta int) error {
+	if b.AccountIsActive(subjectDid) {
+		if err := bumpActorCount(ctx, tx, author, "follows", delta); err != nil {
+			return err
+		}
+	}
+
+	if b.AccountIsActive(authorDid) {
+		if err := bumpActorCount(ctx, tx, subject, "followers", delta); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
@@ -16,6 +17,7 @@ import (
 	"github.com/bluesky-social/indigo/repo"
 	jsmodels "github.com/bluesky-social/jetstream/pkg/models"
 	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -30,6 +32,13 @@ var handleOpHist = promauto.NewHistogramVec(prometheus.HistogramOpts{
 }, []string{"op", "collection"})
 
 func (b *PostgresBackend) HandleEvent(ctx context.Context, evt *atproto.SyncSubscribeRepos_Commit) error {
+	relevant := b.DidIsRelevant(evt.Repo)
+	if relevant {
+		if err := b.checkRevGap(ctx, evt); err != nil {
+			return err
+		}
+	}
+
 	r, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(evt.Blocks))
 	if err != nil {
 		return fmt.Errorf("failed to read event repo: %w", err)
@@ -60,12 +69,16 @@ func (b *PostgresBackend) HandleEvent(ctx context.Context, evt *atproto.SyncSubs
 		}
 	}
 
-	// TODO: sync with the Since field to make sure we don't miss events we care about
-	/*
-		if err := bf.Store.UpdateRev(ctx, evt.Repo, evt.Rev); err != nil {
-			return fmt.Errorf("failed to update rev: %w", err)
+	if relevant {
+		rr, err := b.GetOrCreateRepo(ctx, evt.Repo)
+		if err != nil {
+			return err
 		}
-	*/
+
+		if err := b.setRepoRev(ctx, rr, evt.Rev, r.SignedCommit().Data.String()); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -136,8 +149,6 @@ func (b *PostgresBackend) HandleEventJetstream(ctx context.Context, evt *jsmodel
 }
 
 func (b *PostgresBackend) HandleCreate(ctx context.Context, repo string, rev string, path string, rec *[]byte, cid *cid.Cid) error {
-	start := time.Now()
-
 	rr, err := b.GetOrCreateRepo(ctx, repo)
 	if err != nil {
 		return fmt.Errorf("get user failed: %w", err)
@@ -154,6 +165,20 @@ func (b *PostgresBackend) HandleCreate(ctx context.Context, repo string, rev str
 		}
 	}
 
+	if err := b.createRecord(ctx, rr, rev, path, rec, cid); err != nil {
+		return err
+	}
+
+	b.revCache.Add(rr.ID, rev)
+	return nil
+}
+
+// createRecord indexes a single record without checking it against the last
+// rev we processed for the repo. Used directly when ingesting a full repo
+// snapshot, which may be older than live events we already applied.
+func (b *PostgresBackend) createRecord(ctx context.Context, rr *Repo, rev string, path string, rec *[]byte, cid *cid.Cid) error {
+	start := time.Now()
+
 	parts := strings.Split(path, "/")
 	if len(parts) != 2 {
 		return fmt.Errorf("invalid path in HandleCreate: %q", path)
@@ -227,10 +252,21 @@ func (b *PostgresBackend) HandleCreate(ctx context.Context, repo string, rev str
 			return err
 		}
 	default:
-		slog.Debug("unrecognized record type", "repo", repo, "path", path, "rev", rev)
+		if h := b.recordHandler(col); h != nil {
+			if err := h.create(ctx, b, rr, rkey, *rec, *cid); err != nil {
+				return err
+			}
+		} else if b.StoresCollection(col) {
+			if err := b.HandleCreateGenericRecord(ctx, rr, col, rkey, *rec, *cid); err != nil {
+				return err
+			}
+		} else {
+			slog.Debug("unrecognized record type", "repo", rr.Did, "path", path, "rev", rev)
+			return nil
+		}
 	}
 
-	b.revCache.Add(rr.ID, rev)
+	b.recordChanged(rr.Did, col, rkey)
 	return nil
 }
 
@@ -245,6 +281,18 @@ func (b *PostgresBackend) HandleCreatePost(ctx context.Context, repo *Repo, rkey
 		return nil
 	}
 
+	return b.indexPost(ctx, repo, rkey, recb, cc, true)
+}
+
+// HandleUpdatePost re-indexes an edited post in place, keeping its ID so
+// likes, reposts and replies that point at it stay attached.
+func (b *PostgresBackend) HandleUpdatePost(ctx context.Context, repo *Repo, rkey string, recb []byte, cc cid.Cid) error {
+	return b.indexPost(ctx, repo, rkey, recb, cc, false)
+}
+
+// indexPost writes a post, replacing any existing row for it. Notifications
+// are only sent for new posts.
+func (b *PostgresBackend) indexPost(ctx context.Context, repo *Repo, rkey string, recb []byte, cc cid.Cid, notify bool) error {
 	var rec bsky.FeedPost
 	if err := rec.UnmarshalCBOR(bytes.NewReader(recb)); err != nil {
 		uri := "at://" + repo.Did + "/app.bsky.feed.post/" + rkey
@@ -252,12 +300,20 @@ func (b *PostgresBackend) HandleCreatePost(ctx context.Context, repo *Repo, rkey
 		return nil // Skip this post rather than failing the entire event
 	}
 
+	mentions := postMentions(&rec)
+	quoted := postQuoteUri(&rec)
+
 	reldids := []string{repo.Did}
 	// care about a post if its in a thread of a user we are interested in
 	if rec.Reply != nil && rec.Reply.Parent != nil && rec.Reply.Root != nil {
 		reldids = append(reldids, rec.Reply.Parent.Uri, rec.Reply.Root.Uri)
 	}
-	// TODO: maybe also care if its mentioning a user we care about or quoting a user we care about?
+	// or if it mentions or quotes someone we are interested in, so that
+	// mention and quote notifications work for people we don't follow
+	reldids = append(reldids, mentions...)
+	if quoted != "" {
+		reldids = append(reldids, quoted)
+	}
 	if !b.anyRelevantIdents(reldids...) {
 		return nil
 	}
@@ -299,67 +355,81 @@ func (b *PostgresBackend) HandleCreatePost(ctx context.Context, repo *Repo, rkey
 
 		p.InThread = thread
 
-		r, err := b.GetOrCreateRepo(ctx, b.mydid)
-		if err != nil {
-			return err
-		}
-
-		if p.ReplyToUsr == r.ID {
-			if err := b.AddNotification(ctx, r.ID, p.Author, uri, cc, NotifKindReply); err != nil {
+		if notify && b.localUserByRepo(p.ReplyToUsr) != nil {
+			if err := b.AddNotification(ctx, p.ReplyToUsr, p.Author, uri, cc, NotifKindReply); err != nil {
 				slog.Warn("failed to create notification", "uri", uri, "error", err)
 			}
 		}
 	}
 
-	if rec.Embed != nil {
-		var rpref string
-		if rec.Embed.EmbedRecord != nil && rec.Embed.EmbedRecord.Record != nil {
-			rpref = rec.Embed.EmbedRecord.Record.Uri
-		}
-		if rec.Embed.EmbedRecordWithMedia != nil &&
-			rec.Embed.EmbedRecordWithMedia.Record != nil &&
-			rec.Embed.EmbedRecordWithMedia.Record.Record != nil {
-			rpref = rec.Embed.EmbedRecordWithMedia.Record.Record.Uri
+	var quotedAuthor uint
+	if quoted != "" && strings.Contains(quoted, "app.bsky.feed.post") {
+		qinfo, err := b.postInfoForUri(ctx, quoted)
+		if err != nil {
+			return fmt.Errorf("getting quote subject: %w", err)
 		}
 
-		if rpref != "" && strings.Contains(rpref, "app.bsky.feed.post") {
-			rp, err := b.postIDForUri(ctx, rpref)
-			if err != nil {
-				return fmt.Errorf("getting quote subject: %w", err)
-			}
+		p.Reposting = qinfo.ID
+		quotedAuthor = qinfo.Author
+	}
+
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-			p.Reposting = rp
+	// what the counters already have from a previous version of the post
+	var prev Post
+	if err := tx.QueryRow(ctx, "SELECT reply_to, reposting, not_found FROM posts WHERE author = $1 AND rkey = $2 FOR UPDATE", repo.ID, rkey).Scan(&prev.ReplyTo, &prev.Reposting, &prev.NotFound); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
 		}
+		prev.NotFound = true
 	}
 
-	if err := b.doPostCreate(ctx, &p); err != nil {
+	if err := b.doPostCreate(ctx, tx, &p); err != nil {
 		return err
 	}
 
-	// Check for mentions and create notifications
-	if rec.Facets != nil {
-		for _, facet := range rec.Facets {
-			for _, feature := range facet.Features {
-				if feature.RichtextFacet_Mention != nil {
-					mentionDid := feature.RichtextFacet_Mention.Did
-					// This is a mention
-					mentionedRepo, err := b.GetOrCreateRepo(ctx, mentionDid)
-					if err != nil {
-						slog.Warn("failed to get repo for mention", "did", mentionDid, "error", err)
-						continue
-					}
+	if err := b.updatePostCounts(ctx, tx, repo, &prev, &p); err != nil {
+		return err
+	}
 
-					// Create notification if the mentioned user is the current user
-					if mentionedRepo.ID == b.myrepo.ID {
-						if err := b.AddNotification(ctx, b.myrepo.ID, p.Author, uri, cc, NotifKindMention); err != nil {
-							slog.Warn("failed to create mention notification", "uri", uri, "error", err)
-						}
-					}
-				}
+	if err := indexPostSearch(ctx, tx, &p, &rec); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// Create notifications for mentioned local users
+	for _, mentionDid := range mentions {
+		if !notify {
+			break
+		}
+
+		mentionedRepo, err := b.GetOrCreateRepo(ctx, mentionDid)
+		if err != nil {
+			slog.Warn("failed to get repo for mention", "did", mentionDid, "error", err)
+			continue
+		}
+
+		if b.localUserByRepo(mentionedRepo.ID) != nil {
+			if err := b.AddNotification(ctx, mentionedRepo.ID, p.Author, uri, cc, NotifKindMention); err != nil {
+				slog.Warn("failed to create mention notification", "uri", uri, "error", err)
 			}
 		}
 	}
 
+	// Create notification if the quoted post belongs to a local user
+	if notify && quotedAuthor != 0 && quotedAuthor != p.Author && b.localUserByRepo(quotedAuthor) != nil {
+		if err := b.AddNotification(ctx, quotedAuthor, p.Author, uri, cc, NotifKindQuote); err != nil {
+			slog.Warn("failed to create quote notification", "uri", uri, "error", err)
+		}
+	}
+
 	b.postInfoCache.Add(uri, cachedPostInfo{
 		ID:     p.ID,
 		Author: p.Author,
@@ -368,7 +438,7 @@ func (b *PostgresBackend) HandleCreatePost(ctx context.Context, repo *Repo, rkey
 	return nil
 }
 
-func (b *PostgresBackend) doPostCreate(ctx context.Context, p *Post) error {
+func (b *PostgresBackend) doPostCreate(ctx context.Context, tx pgx.Tx, p *Post) error {
 	/*
 		if err := b.db.Clauses(clause.OnConflict{
 			Columns:   []clause.Column{{Name: "author"}, {Name: "rkey"}},
@@ -391,12 +461,13 @@ DO UPDATE SET
     reposting = $8,
     reply_to = $9,
     reply_to_usr = $10,
-    in_thread = $11
+    in_thread = $11,
+    deleted = false
 RETURNING id
 `
 
 	// Execute the query with parameters from the Post struct
-	if err := b.pgx.QueryRow(
+	if err := tx.QueryRow(
 		ctx,
 		query,
 		p.Author,
@@ -437,7 +508,13 @@ func (b *PostgresBackend) HandleCreateLike(ctx context.Context, repo *Repo, rkey
 		return fmt.Errorf("getting like subject: %w", err)
 	}
 
-	if _, err := b.pgx.Exec(ctx, `INSERT INTO "likes" ("created","indexed","author","rkey","subject","cid") VALUES ($1, $2, $3, $4, $5, $6)`, created.Time(), time.Now(), repo.ID, rkey, pinfo.ID, cc.String()); err != nil {
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `INSERT INTO "likes" ("created","indexed","author","rkey","subject","cid") VALUES ($1, $2, $3, $4, $5, $6)`, created.Time(), time.Now(), repo.ID, rkey, pinfo.ID, cc.String()); err != nil {
 		pgErr, ok := err.(*pgconn.PgError)
 		if ok && pgErr.Code == "23505" {
 			return nil
@@ -445,10 +522,20 @@ func (b *PostgresBackend) HandleCreateLike(ctx context.Context, repo *Repo, rkey
 		return err
 	}
 
-	// Create notification if the liked post belongs to the current user
-	if pinfo.Author == b.myrepo.ID {
+	if b.AccountIsActive(repo.Did) {
+		if err := bumpPostCount(ctx, tx, pinfo.ID, "likes", 1); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// Create notification if the liked post belongs to a local user
+	if b.localUserByRepo(pinfo.Author) != nil {
 		uri := fmt.Sprintf("at://%s/app.bsky.feed.like/%s", repo.Did, rkey)
-		if err := b.AddNotification(ctx, b.myrepo.ID, repo.ID, uri, cc, NotifKindLike); err != nil {
+		if err := b.AddNotification(ctx, pinfo.Author, repo.ID, uri, cc, NotifKindLike); err != nil {
 			slog.Warn("failed to create like notification", "uri", uri, "error", err)
 		}
 	}
@@ -476,7 +563,13 @@ func (b *PostgresBackend) HandleCreateRepost(ctx context.Context, repo *Repo, rk
 		return fmt.Errorf("getting repost subject: %w", err)
 	}
 
-	if _, err := b.pgx.Exec(ctx, `INSERT INTO "reposts" ("created","indexed","author","rkey","subject") VALUES ($1, $2, $3, $4, $5)`, created.Time(), time.Now(), repo.ID, rkey, pinfo.ID); err != nil {
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `INSERT INTO "reposts" ("created","indexed","author","rkey","subject") VALUES ($1, $2, $3, $4, $5)`, created.Time(), time.Now(), repo.ID, rkey, pinfo.ID); err != nil {
 		pgErr, ok := err.(*pgconn.PgError)
 		if ok && pgErr.Code == "23505" {
 			return nil
@@ -484,10 +577,20 @@ func (b *PostgresBackend) HandleCreateRepost(ctx context.Context, repo *Repo, rk
 		return err
 	}
 
-	// Create notification if the reposted post belongs to the current user
-	if pinfo.Author == b.myrepo.ID {
+	if b.AccountIsActive(repo.Did) {
+		if err := bumpPostCount(ctx, tx, pinfo.ID, "reposts", 1); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// Create notification if the reposted post belongs to a local user
+	if b.localUserByRepo(pinfo.Author) != nil {
 		uri := fmt.Sprintf("at://%s/app.bsky.feed.repost/%s", repo.Did, rkey)
-		if err := b.AddNotification(ctx, b.myrepo.ID, repo.ID, uri, cc, NotifKindRepost); err != nil {
+		if err := b.AddNotification(ctx, pinfo.Author, repo.ID, uri, cc, NotifKindRepost); err != nil {
 			slog.Warn("failed to create repost notification", "uri", uri, "error", err)
 		}
 	}
@@ -515,9 +618,34 @@ func (b *PostgresBackend) HandleCreateFollow(ctx context.Context, repo *Repo, rk
 		return err
 	}
 
-	if _, err := b.pgx.Exec(ctx, "INSERT INTO follows (created, indexed, author, rkey, subject) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING", created.Time(), time.Now(), repo.ID, rkey, subj.ID); err != nil {
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, "INSERT INTO follows (created, indexed, author, rkey, subject) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING", created.Time(), time.Now(), repo.ID, rkey, subj.ID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() > 0 {
+		if err := b.bumpFollowCounts(ctx, tx, repo.ID, repo.Did, subj.ID, subj.Did, 1); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if u := b.localUserByRepo(repo.ID); u != nil {
+		b.handleLocalFollow(ctx, u, rec.Subject)
+	}
+
+	if err := b.followGraphChanged(ctx, repo.Did, subj); err != nil {
+		return fmt.Errorf("failed to update relevant set after follow: %w", err)
+	}
 
 	return nil
 }
@@ -570,6 +698,20 @@ func (b *PostgresBackend) HandleCreateList(ctx context.Context, repo *Repo, rkey
 		return fmt.Errorf("invalid timestamp: %w", err)
 	}
 
+	// a list item or starter pack referencing the list may have created a
+	// placeholder row for it already, and updates land here too
+	res := b.db.Model(&List{}).Where("author = ? AND rkey = ?", repo.ID, rkey).Updates(map[string]any{
+		"created": created.Time(),
+		"indexed": time.Now(),
+		"raw":     recb,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
 	if err := b.db.Create(&List{
 		Created: created.Time(),
 		Indexed: time.Now(),
@@ -669,6 +811,10 @@ func (b *PostgresBackend) HandleCreateProfile(ctx context.Context, repo *Repo, r
 		return err
 	}
 
+	if err := b.indexActorSearch(ctx, repo, recb); err != nil {
+		slog.Warn("failed to index profile for search", "did", repo.Did, "error", err)
+	}
+
 	return nil
 }
 
@@ -686,6 +832,10 @@ func (b *PostgresBackend) HandleUpdateProfile(ctx context.Context, repo *Repo, r
 		return err
 	}
 
+	if err := b.indexActorSearch(ctx, repo, recb); err != nil {
+		slog.Warn("failed to index profile for search", "did", repo.Did, "error", err)
+	}
+
 	return nil
 }
 
@@ -704,6 +854,19 @@ func (b *PostgresBackend) HandleCreateFeedGenerator(ctx context.Context, repo *R
 		return fmt.Errorf("invalid timestamp: %w", err)
 	}
 
+	res := b.db.Model(&FeedGenerator{}).Where("author = ? AND rkey = ?", repo.ID, rkey).Updates(map[string]any{
+		"created": created.Time(),
+		"indexed": time.Now(),
+		"did":     rec.Did,
+		"raw":     recb,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
 	if err := b.db.Create(&FeedGenerator{
 		Created: created.Time(),
 		Indexed: time.Now(),
@@ -737,13 +900,17 @@ func (b *PostgresBackend) HandleCreateThreadgate(ctx context.Context, repo *Repo
 		return err
 	}
 
-	if err := b.db.Create(&ThreadGate{
-		Created: created.Time(),
-		Indexed: time.Now(),
-		Author:  repo.ID,
-		Rkey:    rkey,
-		Post:    pid,
-	}).Error; err != nil {
+	// the allow rules live in the raw record, so an update has to replace it
+	// along with the post it gates
+	tag, err := b.pgx.Exec(ctx, "UPDATE thread_gates SET created = $1, indexed = $2, post = $3, raw = $4 WHERE author = $5 AND rkey = $6", created.Time(), time.Now(), pid, recb, repo.ID, rkey)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+
+	if _, err := b.pgx.Exec(ctx, "INSERT INTO thread_gates (created, indexed, author, rkey, post, raw) VALUES ($1, $2, $3, $4, $5, $6)", created.Time(), time.Now(), repo.ID, rkey, pid, recb); err != nil {
 		return err
 	}
 
@@ -773,6 +940,19 @@ func (b *PostgresBackend) HandleCreatePostGate(ctx context.Context, repo *Repo,
 		return err
 	}
 
+	res := b.db.Model(&PostGate{}).Where("author = ? AND rkey = ?", repo.ID, rkey).Updates(map[string]any{
+		"created": created.Time(),
+		"indexed": time.Now(),
+		"subject": refPost.ID,
+		"raw":     recb,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
 	if err := b.db.Create(&PostGate{
 		Created: created.Time(),
 		Indexed: time.Now(),
@@ -805,6 +985,19 @@ func (b *PostgresBackend) HandleCreateStarterPack(ctx context.Context, repo *Rep
 		return err
 	}
 
+	res := b.db.Model(&StarterPack{}).Where("author = ? AND rkey = ?", repo.ID, rkey).Updates(map[string]any{
+		"created": created.Time(),
+		"indexed": time.Now(),
+		"raw":     recb,
+		"list":    list.ID,
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
 	if err := b.db.Create(&StarterPack{
 		Created: created.Time(),
 		Indexed: time.Now(),
@@ -854,68 +1047,76 @@ func (b *PostgresBackend) HandleUpdate(ctx context.Context, repo string, rev str
 	}
 
 	switch col {
-	/*
-		case "app.bsky.feed.post":
-			if err := s.HandleCreatePost(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.feed.like":
-			if err := s.HandleCreateLike(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.feed.repost":
-			if err := s.HandleCreateRepost(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.graph.follow":
-			if err := s.HandleCreateFollow(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.graph.block":
-			if err := s.HandleCreateBlock(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.graph.list":
-			if err := s.HandleCreateList(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.graph.listitem":
-			if err := s.HandleCreateListitem(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-		case "app.bsky.graph.listblock":
-			if err := s.HandleCreateListblock(ctx, rr, rkey, *rec, *cid); err != nil {
-				return err
-			}
-	*/
+	case "app.bsky.feed.post":
+		if err := b.HandleUpdatePost(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
+	case "app.bsky.feed.like", "app.bsky.feed.repost", "app.bsky.graph.follow",
+		"app.bsky.graph.block", "app.bsky.graph.listitem", "app.bsky.graph.listblock":
+		if err := b.replaceRecord(ctx, rr, rev, path, rec, cid); err != nil {
+			return err
+		}
 	case "app.bsky.actor.profile":
 		if err := b.HandleUpdateProfile(ctx, rr, rkey, rev, *rec, *cid); err != nil {
 			return err
 		}
-		/*
-			case "app.bsky.feed.generator":
-				if err := s.HandleCreateFeedGenerator(ctx, rr, rkey, *rec, *cid); err != nil {
-					return err
-				}
-			case "app.bsky.feed.threadgate":
-				if err := s.HandleCreateThreadgate(ctx, rr, rkey, *rec, *cid); err != nil {
-					return err
-				}
-			case "chat.bsky.actor.declaration":
-				if err := s.HandleCreateChatDeclaration(ctx, rr, rkey, *rec, *cid); err != nil {
-					return err
-				}
-		*/
+	// the create handlers for these upsert
+	case "app.bsky.graph.list":
+		if err := b.HandleCreateList(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
+	case "app.bsky.feed.generator":
+		if err := b.HandleCreateFeedGenerator(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
+	case "app.bsky.feed.threadgate":
+		if err := b.HandleCreateThreadgate(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
+	case "chat.bsky.actor.declaration":
+		if err := b.HandleCreateChatDeclaration(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
+	case "app.bsky.feed.postgate":
+		if err := b.HandleCreatePostGate(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
+	case "app.bsky.graph.starterpack":
+		if err := b.HandleCreateStarterPack(ctx, rr, rkey, *rec, *cid); err != nil {
+			return err
+		}
 	default:
-		slog.Debug("unrecognized record type in update", "repo", repo, "path", path, "rev", rev)
+		if h := b.recordHandler(col); h != nil {
+			if err := h.update(ctx, b, rr, rkey, *rec, *cid); err != nil {
+				return err
+			}
+		} else if b.StoresCollection(col) {
+			if err := b.HandleCreateGenericRecord(ctx, rr, col, rkey, *rec, *cid); err != nil {
+				return err
+			}
+		} else {
+			slog.Debug("unrecognized record type in update", "repo", repo, "path", path, "rev", rev)
+			return nil
+		}
 	}
 
+	b.recordChanged(rr.Did, col, rkey)
 	return nil
 }
 
-func (b *PostgresBackend) HandleDelete(ctx context.Context, repo string, rev string, path string) error {
-	start := time.Now()
+// replaceRecord applies an update to a record that only links two things
+// together, like a follow or a list item, by deleting the old version and
+// indexing the new one. This keeps the relevant set, list membership and
+// notifications in line with whatever the record points at now.
+func (b *PostgresBackend) replaceRecord(ctx context.Context, rr *Repo, rev string, path string, rec *[]byte, cid *cid.Cid) error {
+	if err := b.deleteRecord(ctx, rr, path); err != nil {
+		return fmt.Errorf("removing old version: %w", err)
+	}
+
+	return b.createRecord(ctx, rr, rev, path, rec, cid)
+}
 
+func (b *PostgresBackend) HandleDelete(ctx context.Context, repo string, rev string, path string) error {
 	rr, err := b.GetOrCreateRepo(ctx, repo)
 	if err != nil {
 		return fmt.Errorf("get user failed: %w", err)
@@ -929,6 +1130,19 @@ func (b *PostgresBackend) HandleDelete(ctx context.Context, repo string, rev str
 		}
 	}
 
+	if err := b.deleteRecord(ctx, rr, path); err != nil {
+		return err
+	}
+
+	b.revCache.Add(rr.ID, rev)
+	return nil
+}
+
+// deleteRecord removes a single record from the index without checking it
+// against the last rev we processed for the repo.
+func (b *PostgresBackend) deleteRecord(ctx context.Context, rr *Repo, path string) error {
+	start := time.Now()
+
 	parts := strings.Split(path, "/")
 	if len(parts) != 2 {
 		return fmt.Errorf("invalid path in HandleDelete: %q", path)
@@ -985,11 +1199,30 @@ func (b *PostgresBackend) HandleDelete(ctx context.Context, repo string, rev str
 		if err := b.HandleDeleteThreadgate(ctx, rr, rkey); err != nil {
 			return err
 		}
+	case "app.bsky.feed.postgate":
+		if err := b.HandleDeletePostGate(ctx, rr, rkey); err != nil {
+			return err
+		}
+	case "app.bsky.graph.starterpack":
+		if err := b.HandleDeleteStarterPack(ctx, rr, rkey); err != nil {
+			return err
+		}
 	default:
-		slog.Warn("delete unrecognized record type", "repo", repo, "path", path, "rev", rev)
+		if h := b.recordHandler(col); h != nil {
+			if err := h.Delete(ctx, b, rr, rkey); err != nil {
+				return err
+			}
+		} else if b.StoresCollection(col) {
+			if err := b.HandleDeleteGenericRecord(ctx, rr, col, rkey); err != nil {
+				return err
+			}
+		} else {
+			slog.Warn("delete unrecognized record type", "repo", rr.Did, "path", path)
+			return nil
+		}
 	}
 
-	b.revCache.Add(rr.ID, rev)
+	b.recordChanged(rr.Did, col, rkey)
 	return nil
 }
 
@@ -1004,10 +1237,83 @@ func (b *PostgresBackend) HandleDeletePost(ctx context.Context, repo *Repo, rkey
 		return nil
 	}
 
-	if err := b.db.Delete(&Post{}, p.ID).Error; err != nil {
+	uri := "at://" + repo.Did + "/app.bsky.feed.post/" + rkey
+
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// notifications the post itself caused (replies, mentions and quotes),
+	// and the ones caused by likes and reposts of it
+	if _, err := tx.Exec(ctx, "DELETE FROM notifications WHERE source = $1", uri); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM notifications n USING likes l JOIN repos r ON r.id = l.author
+WHERE l.subject = $1 AND n.source = 'at://' || r.did || '/app.bsky.feed.like/' || l.rkey`, p.ID); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM notifications n USING reposts rp JOIN repos r ON r.id = rp.author
+WHERE rp.subject = $1 AND n.source = 'at://' || r.did || '/app.bsky.feed.repost/' || rp.rkey`, p.ID); err != nil {
+		return err
+	}
+
+	for _, q := range []string{
+		"DELETE FROM likes WHERE subject = $1",
+		"DELETE FROM reposts WHERE subject = $1",
+		"DELETE FROM thread_gates WHERE post = $1",
+		"DELETE FROM post_gates WHERE subject = $1",
+		"DELETE FROM post_searches WHERE post = $1",
+	} {
+		if _, err := tx.Exec(ctx, q, p.ID); err != nil {
+			return err
+		}
+	}
+
+	// replies and quotes point at the post by ID, so if there are any we
+	// keep the row as a tombstone and threads and quote embeds show it as
+	// deleted rather than losing track of it
+	var referenced bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM posts WHERE reply_to = $1 OR in_thread = $1 OR reposting = $1)", p.ID).Scan(&referenced); err != nil {
 		return err
 	}
 
+	if referenced {
+		if _, err := tx.Exec(ctx, "UPDATE posts SET deleted = true, not_found = true, raw = NULL, cid = '' WHERE id = $1", p.ID); err != nil {
+			return err
+		}
+
+		// the likes and reposts are gone, replies and quotes are still around
+		if _, err := tx.Exec(ctx, "UPDATE post_counts SET likes = 0, reposts = 0 WHERE post = $1", p.ID); err != nil {
+			return err
+		}
+	} else {
+		if _, err := tx.Exec(ctx, "DELETE FROM posts WHERE id = $1", p.ID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, "DELETE FROM post_counts WHERE post = $1", p.ID); err != nil {
+			return err
+		}
+	}
+
+	if !p.NotFound {
+		if err := b.removePostCounts(ctx, tx, repo, &p); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if !referenced {
+		b.postInfoCache.Remove(uri)
+	}
+
 	return nil
 }
 
@@ -1022,11 +1328,28 @@ func (b *PostgresBackend) HandleDeleteLike(ctx context.Context, repo *Repo, rkey
 		return nil
 	}
 
-	if err := b.db.Exec("DELETE FROM likes WHERE id = ?", like.ID).Error; err != nil {
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	return nil
+	if _, err := tx.Exec(ctx, "DELETE FROM likes WHERE id = $1", like.ID); err != nil {
+		return err
+	}
+
+	uri := "at://" + repo.Did + "/app.bsky.feed.like/" + rkey
+	if _, err := tx.Exec(ctx, "DELETE FROM notifications WHERE source = $1", uri); err != nil {
+		return err
+	}
+
+	if b.AccountIsActive(repo.Did) {
+		if err := bumpPostCount(ctx, tx, like.Subject, "likes", -1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (b *PostgresBackend) HandleDeleteRepost(ctx context.Context, repo *Repo, rkey string) error {
@@ -1040,11 +1363,28 @@ func (b *PostgresBackend) HandleDeleteRepost(ctx context.Context, repo *Repo, rk
 		return nil
 	}
 
-	if err := b.db.Exec("DELETE FROM reposts WHERE id = ?", repost.ID).Error; err != nil {
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	return nil
+	if _, err := tx.Exec(ctx, "DELETE FROM reposts WHERE id = $1", repost.ID); err != nil {
+		return err
+	}
+
+	uri := "at://" + repo.Did + "/app.bsky.feed.repost/" + rkey
+	if _, err := tx.Exec(ctx, "DELETE FROM notifications WHERE source = $1", uri); err != nil {
+		return err
+	}
+
+	if b.AccountIsActive(repo.Did) {
+		if err := bumpPostCount(ctx, tx, repost.Subject, "reposts", -1); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
 }
 
 func (b *PostgresBackend) HandleDeleteFollow(ctx context.Context, repo *Repo, rkey string) error {
@@ -1058,10 +1398,49 @@ func (b *PostgresBackend) HandleDeleteFollow(ctx context.Context, repo *Repo, rk
 		return nil
 	}
 
-	if err := b.db.Exec("DELETE FROM follows WHERE id = ?", follow.ID).Error; err != nil {
+	subjDid, err := b.DidFromID(ctx, follow.Subject)
+	if err != nil {
+		return err
+	}
+
+	tx, err := b.pgx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM follows WHERE id = $1", follow.ID); err != nil {
+		return err
+	}
+
+	if err := b.bumpFollowCounts(ctx, tx, repo.ID, repo.Did, follow.Subject, subjDid, -1); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	u := b.localUserByRepo(repo.ID)
+	if u == nil && (b.relCfg.Depth < 2 || len(b.graphUsers(repo.Did)) == 0) {
+		return nil
+	}
+
+	subj, err := b.GetRepoByID(ctx, follow.Subject)
+	if err != nil {
 		return err
 	}
 
+	if u != nil {
+		if err := b.handleLocalUnfollow(ctx, u, subj); err != nil {
+			return fmt.Errorf("failed to update relevant set after unfollow: %w", err)
+		}
+	}
+
+	if err := b.followGraphChanged(ctx, repo.Did, subj); err != nil {
+		return fmt.Errorf("failed to update relevant set after unfollow: %w", err)
+	}
+
 	return nil
 }
 
@@ -1173,6 +1552,22 @@ func (b *PostgresBackend) HandleDeleteThreadgate(ctx context.Context, repo *Repo
 	return nil
 }
 
+func (b *PostgresBackend) HandleDeletePostGate(ctx context.Context, repo *Repo, rkey string) error {
+	if err := b.db.Exec("DELETE FROM post_gates WHERE author = ? AND rkey = ?", repo.ID, rkey).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *PostgresBackend) HandleDeleteStarterPack(ctx context.Context, repo *Repo, rkey string) error {
+	if err := b.db.Exec("DELETE FROM starter_packs WHERE author = ? AND rkey = ?", repo.ID, rkey).Error; err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (b *PostgresBackend) HandleDeleteProfile(ctx context.Context, repo *Repo, rkey string) error {
 	var profile Profile
 	if err := b.db.Find(&profile, "repo = ?", repo.ID).Error; err != nil {
@@ -1187,7 +1582,48 @@ func (b *PostgresBackend) HandleDeleteProfile(ctx context.Context, repo *Repo, r
 		return err
 	}
 
-	return nil
+	return b.removeActorSearch(ctx, repo.ID)
+}
+
+// postMentions returns the DIDs mentioned in a post's facets, without
+// duplicates.
+func postMentions(rec *bsky.FeedPost) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, facet := range rec.Facets {
+		for _, feature := range facet.Features {
+			if feature.RichtextFacet_Mention == nil {
+				continue
+			}
+
+			did := feature.RichtextFacet_Mention.Did
+			if !seen[did] {
+				seen[did] = true
+				out = append(out, did)
+			}
+		}
+	}
+	return out
+}
+
+// postQuoteUri returns the URI of the record a post embeds, or an empty
+// string if it doesn't embed one.
+func postQuoteUri(rec *bsky.FeedPost) string {
+	if rec.Embed == nil {
+		return ""
+	}
+
+	if rec.Embed.EmbedRecord != nil && rec.Embed.EmbedRecord.Record != nil {
+		return rec.Embed.EmbedRecord.Record.Uri
+	}
+
+	if rec.Embed.EmbedRecordWithMedia != nil &&
+		rec.Embed.EmbedRecordWithMedia.Record != nil &&
+		rec.Embed.EmbedRecordWithMedia.Record.Record != nil {
+		return rec.Embed.EmbedRecordWithMedia.Record.Record.Uri
+	}
+
+	return ""
 }
 
 const (
@@ -1195,6 +1631,7 @@ const (
 	NotifKindLike    = "like"
 	NotifKindMention = "mention"
 	NotifKindRepost  = "repost"
+	NotifKindQuote   = "quote"
 )
 
 func (b *PostgresBackend) AddNotification(ctx context.Context, forUser, author uint, recordUri string, recordCid cid.Cid, kind string) error {
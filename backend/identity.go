@@ -0,0 +1,74 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+// HandleIdentityEvent processes an #identity event. For accounts we know
+// about, cached identity data for the DID (and its old and new handles) is
+// purged from the directory and the DID is re-resolved so the fresh, verified
+// handle is served right away.
+func (b *PostgresBackend) HandleIdentityEvent(ctx context.Context, evt *atproto.SyncSubscribeRepos_Identity) error {
+	did, err := syntax.ParseDID(evt.Did)
+	if err != nil {
+		return fmt.Errorf("invalid did in identity event: %w", err)
+	}
+
+	rid, err := b.lookupRepoID(ctx, did.String())
+	if err != nil {
+		return err
+	}
+
+	// we have never indexed anything for this account, don't resolve it just
+	// to drop its cache entries
+	if rid == 0 {
+		return nil
+	}
+
+	// grab the handle we currently have cached so its reverse mapping gets
+	// dropped as well
+	var oldHandle syntax.Handle
+	if ident, err := b.dir.LookupDID(ctx, did); err == nil {
+		oldHandle = ident.Handle
+	}
+
+	if err := b.dir.Purge(ctx, did.AtIdentifier()); err != nil {
+		return fmt.Errorf("purging identity %s: %w", did, err)
+	}
+	b.actorChanged(did.String())
+
+	if oldHandle != "" && oldHandle != syntax.HandleInvalid {
+		if err := b.dir.Purge(ctx, oldHandle.AtIdentifier()); err != nil {
+			slog.Warn("failed to purge old handle", "did", did, "handle", oldHandle, "error", err)
+		}
+	}
+
+	if evt.Handle != nil && *evt.Handle != "" {
+		if h, err := syntax.ParseHandle(*evt.Handle); err == nil && h != syntax.HandleInvalid {
+			if err := b.dir.Purge(ctx, h.AtIdentifier()); err != nil {
+				slog.Warn("failed to purge new handle", "did", did, "handle", h, "error", err)
+			}
+		}
+	}
+
+	ident, err := b.dir.LookupDID(ctx, did)
+	if err != nil {
+		slog.Warn("failed to re-resolve identity", "did", did, "error", err)
+		return nil
+	}
+
+	if ident.Handle != oldHandle {
+		slog.Info("handle changed", "did", did, "old", oldHandle, "new", ident.Handle)
+	}
+
+	if err := b.updateSearchHandle(ctx, rid, ident.Handle); err != nil {
+		slog.Warn("failed to update search handle", "did", did, "error", err)
+	}
+
+	return nil
+}
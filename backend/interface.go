@@ -10,3 +10,18 @@ type RecordTracker interface {
 	// wait: if true, blocks until the record is fetched
 	TrackMissingRecord(identifier string, wait bool)
 }
+
+// RecordListener is told about changes to the index so that caches built on
+// top of it can drop stale entries. Calls are made after the change has been
+// written.
+type RecordListener interface {
+	// RecordChanged is called when a record is created, updated or deleted
+	RecordChanged(uri string)
+
+	// ActorChanged is called when an account's identity or status changes
+	ActorChanged(did string)
+
+	// ActorPurged is called when all of an account's records have been
+	// removed at once, without an event for each of them
+	ActorPurged(did string)
+}
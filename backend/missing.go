@@ -3,14 +3,23 @@ package backend
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	xrpclib "github.com/bluesky-social/indigo/xrpc"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type MissingRecordType string
@@ -26,71 +35,430 @@ type MissingRecord struct {
 	Type       MissingRecordType
 	Identifier string // DID for profiles, AT-URI for posts/feedgens
 	Wait       bool
+}
+
+var missingRecordsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "missing_records_fetched",
+	Help: "Number of missing record fetch attempts, by result",
+}, []string{"result"})
+
+var missingRecordsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "missing_records_queued",
+	Help: "Number of missing records waiting for a fetch worker",
+})
+
+const (
+	missingFetchWorkers     = 16
+	missingFetchPerPDS      = 4
+	missingFetchTimeout     = time.Second * 30
+	missingFetchMaxAttempts = 6
+
+	// beyond this many queued records new ones only go into the table, and
+	// are picked up from there once the queue has drained
+	missingFetchMaxQueued = 10_000
+
+	missingNotFoundTTL = time.Hour
+)
+
+// missingFetch is a missing record that is queued or being fetched. Callers
+// asking for a record that is already in flight wait on the same fetch.
+type missingFetch struct {
+	rec  MissingRecord
+	done chan struct{}
+}
+
+// missingFetcher fetches records we have seen references to but haven't
+// indexed. Every queued record has a row in missing_record_jobs, which is
+// how failed fetches get retried and how the queue survives restarts.
+type missingFetcher struct {
+	b *PostgresBackend
+
+	inflight map[string]*missingFetch
+	queue    []*missingFetch
+	lk       sync.Mutex
+
+	wake chan struct{}
+
+	// records the PDS told us don't exist, with when to believe it again
+	notFound *lru.TwoQueueCache[string, time.Time]
+
+	pdsSlots map[string]chan struct{}
+	pdsLk    sync.Mutex
+}
+
+func newMissingFetcher(b *PostgresBackend) *missingFetcher {
+	nf, _ := lru.New2Q[string, time.Time](100_000)
+
+	return &missingFetcher{
+		b:        b,
+		inflight: make(map[string]*missingFetch),
+		wake:     make(chan struct{}, 1),
+		notFound: nf,
+		pdsSlots: make(map[string]chan struct{}),
+	}
+}
+
+func (mf *missingFetcher) start(ctx context.Context) {
+	for i := 0; i < missingFetchWorkers; i++ {
+		go mf.worker(ctx)
+	}
 
-	waitch chan struct{}
+	go mf.poller(ctx)
 }
 
 func (b *PostgresBackend) addMissingRecord(ctx context.Context, rec MissingRecord) {
-	if rec.Wait {
-		rec.waitch = make(chan struct{})
+	if rec.Type == MissingRecordTypeUnknown {
+		slog.Error("unknown missing record type", "identifier", rec.Identifier)
+		return
+	}
+
+	done := b.missing.enqueue(ctx, rec)
+	if done == nil || !rec.Wait {
+		return
 	}
 
 	select {
-	case b.missingRecords <- rec:
+	case <-done:
 	case <-ctx.Done():
 	}
+}
+
+// enqueue queues a record for fetching and returns a channel that is closed
+// once the fetch attempt is over. It never blocks on the queue, and returns
+// nil if there is nothing to wait for.
+func (mf *missingFetcher) enqueue(ctx context.Context, rec MissingRecord) <-chan struct{} {
+	if mf.knownMissing(rec.Identifier) {
+		return nil
+	}
+
+	mf.lk.Lock()
+	f, ok := mf.inflight[rec.Identifier]
+	mf.lk.Unlock()
+	if ok {
+		return f.done
+	}
+
+	if _, err := mf.b.pgx.Exec(ctx, `INSERT INTO missing_record_jobs (identifier, type, attempts, error, next_attempt, created_at)
+VALUES ($1, $2, 0, '', NOW(), NOW())
+ON CONFLICT (identifier) DO NOTHING`, rec.Identifier, string(rec.Type)); err != nil {
+		slog.Warn("failed to persist missing record", "identifier", rec.Identifier, "error", err)
+	}
+
+	mf.lk.Lock()
+	defer mf.lk.Unlock()
+
+	if f, ok := mf.inflight[rec.Identifier]; ok {
+		return f.done
+	}
+
+	if !rec.Wait && len(mf.queue) >= missingFetchMaxQueued {
+		return nil
+	}
+
+	f = mf.push(rec)
+	mf.notify()
+	return f.done
+}
+
+// push adds a record to the in-memory queue, the caller must hold lk
+func (mf *missingFetcher) push(rec MissingRecord) *missingFetch {
+	f := &missingFetch{
+		rec:  rec,
+		done: make(chan struct{}),
+	}
+
+	mf.inflight[rec.Identifier] = f
+	mf.queue = append(mf.queue, f)
+	missingRecordsQueued.Set(float64(len(mf.queue)))
+
+	return f
+}
+
+func (mf *missingFetcher) next() *missingFetch {
+	mf.lk.Lock()
+	defer mf.lk.Unlock()
+
+	if len(mf.queue) == 0 {
+		return nil
+	}
+
+	f := mf.queue[0]
+	mf.queue[0] = nil
+	mf.queue = mf.queue[1:]
+	missingRecordsQueued.Set(float64(len(mf.queue)))
+
+	// pass the wakeup on to the next idle worker
+	if len(mf.queue) > 0 {
+		mf.notify()
+	}
+
+	return f
+}
+
+func (mf *missingFetcher) notify() {
+	select {
+	case mf.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (mf *missingFetcher) knownMissing(ident string) bool {
+	until, ok := mf.notFound.Get(ident)
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(until) {
+		mf.notFound.Remove(ident)
+		return false
+	}
+
+	return true
+}
+
+func (mf *missingFetcher) worker(ctx context.Context) {
+	for {
+		f := mf.next()
+		if f != nil {
+			mf.run(ctx, f)
+			continue
+		}
 
-	if rec.Wait {
 		select {
-		case <-rec.waitch:
+		case <-mf.wake:
 		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (b *PostgresBackend) missingRecordFetcher() {
-	for rec := range b.missingRecords {
-		var err error
-		switch rec.Type {
-		case MissingRecordTypeProfile:
-			err = b.fetchMissingProfile(context.TODO(), rec.Identifier)
-		case MissingRecordTypePost:
-			err = b.fetchMissingPost(context.TODO(), rec.Identifier)
-		case MissingRecordTypeFeedGenerator:
-			err = b.fetchMissingFeedGenerator(context.TODO(), rec.Identifier)
-		default:
-			slog.Error("unknown missing record type", "type", rec.Type)
-			continue
-		}
+func (mf *missingFetcher) run(ctx context.Context, f *missingFetch) {
+	fctx, cancel := context.WithTimeout(ctx, missingFetchTimeout)
+	err := mf.b.fetchMissing(fctx, f.rec)
+	cancel()
+
+	ident := f.rec.Identifier
+
+	// the row has to be settled before the record leaves inflight, or the
+	// poller could pick it up again
+	if err := mf.finish(ctx, f.rec, err); err != nil {
+		slog.Error("failed to update missing record job", "identifier", ident, "error", err)
+	}
+
+	mf.lk.Lock()
+	delete(mf.inflight, ident)
+	mf.lk.Unlock()
+
+	close(f.done)
+}
+
+// finish records the outcome of a fetch in the table, deleting the row
+// unless the fetch is to be retried.
+func (mf *missingFetcher) finish(ctx context.Context, rec MissingRecord, ferr error) error {
+	ident := rec.Identifier
+
+	if ferr == nil {
+		missingRecordsCounter.WithLabelValues("fetched").Inc()
+		_, err := mf.b.pgx.Exec(ctx, "DELETE FROM missing_record_jobs WHERE identifier = $1", ident)
+		return err
+	}
+
+	if isNotFoundErr(ferr) {
+		missingRecordsCounter.WithLabelValues("not_found").Inc()
+		mf.notFound.Add(ident, time.Now().Add(missingNotFoundTTL))
+		_, err := mf.b.pgx.Exec(ctx, "DELETE FROM missing_record_jobs WHERE identifier = $1", ident)
+		return err
+	}
+
+	attempts := 1
+	if err := mf.b.pgx.QueryRow(ctx, "UPDATE missing_record_jobs SET attempts = attempts + 1, error = $1 WHERE identifier = $2 RETURNING attempts", ferr.Error(), ident).Scan(&attempts); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if attempts >= missingFetchMaxAttempts {
+		missingRecordsCounter.WithLabelValues("failed").Inc()
+		slog.Warn("giving up on missing record", "type", rec.Type, "identifier", ident, "attempts", attempts, "error", ferr)
+		_, err := mf.b.pgx.Exec(ctx, "DELETE FROM missing_record_jobs WHERE identifier = $1", ident)
+		return err
+	}
+
+	missingRecordsCounter.WithLabelValues("retry").Inc()
+	next := time.Now().Add(missingRetryDelay(attempts))
+	slog.Warn("failed to fetch missing record, will retry", "type", rec.Type, "identifier", ident, "attempt", attempts, "next", next, "error", ferr)
+	_, err := mf.b.pgx.Exec(ctx, "UPDATE missing_record_jobs SET next_attempt = $1 WHERE identifier = $2", next, ident)
+	return err
+}
 
-		if err != nil {
-			slog.Warn("failed to fetch missing record", "type", rec.Type, "identifier", rec.Identifier, "error", err)
+// poller moves records that are due from the table into the queue. That
+// covers retries, records that didn't fit in the queue, and whatever was
+// left over from a previous run.
+func (mf *missingFetcher) poller(ctx context.Context) {
+	tick := time.NewTicker(time.Second * 5)
+	defer tick.Stop()
+
+	for {
+		if err := mf.requeueDue(ctx); err != nil {
+			slog.Error("failed to requeue missing records", "error", err)
 		}
 
-		if rec.Wait {
-			close(rec.waitch)
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (b *PostgresBackend) fetchMissingProfile(ctx context.Context, did string) error {
-	b.AddRelevantDid(did)
+func (mf *missingFetcher) requeueDue(ctx context.Context) error {
+	mf.lk.Lock()
+	room := missingFetchMaxQueued - len(mf.queue)
+	inflight := len(mf.inflight)
+	mf.lk.Unlock()
 
-	repo, err := b.GetOrCreateRepo(ctx, did)
+	if room <= 0 {
+		return nil
+	}
+
+	// records in flight still have their rows, ask for enough to skip them
+	rows, err := mf.b.pgx.Query(ctx, "SELECT identifier, type FROM missing_record_jobs WHERE next_attempt <= NOW() ORDER BY next_attempt LIMIT $1", room+inflight)
 	if err != nil {
 		return err
 	}
 
-	resp, err := b.dir.LookupDID(ctx, syntax.DID(did))
+	type dueRecord struct {
+		Identifier string
+		Type       string
+	}
+	due, err := pgx.CollectRows(rows, pgx.RowToStructByPos[dueRecord])
 	if err != nil {
 		return err
 	}
 
+	mf.lk.Lock()
+	defer mf.lk.Unlock()
+
+	var added int
+	for _, d := range due {
+		if added >= room {
+			break
+		}
+		if _, ok := mf.inflight[d.Identifier]; ok {
+			continue
+		}
+
+		mf.push(MissingRecord{
+			Type:       MissingRecordType(d.Type),
+			Identifier: d.Identifier,
+		})
+		added++
+	}
+
+	if added > 0 {
+		mf.notify()
+	}
+
+	return nil
+}
+
+func missingRetryDelay(attempt int) time.Duration {
+	d := time.Second * 10
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 4
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// isNotFoundErr tells apart records that don't exist from fetches that
+// failed and are worth retrying.
+func isNotFoundErr(err error) bool {
+	if errors.Is(err, identity.ErrDIDNotFound) {
+		return true
+	}
+
+	var xe *xrpclib.XRPCError
+	if !errors.As(err, &xe) {
+		return false
+	}
+
+	switch xe.ErrStr {
+	case "RecordNotFound", "RepoNotFound":
+		return true
+	case "InvalidRequest":
+		// what the reference PDS returns for a missing record
+		return strings.HasPrefix(xe.Message, "Could not locate record")
+	default:
+		return false
+	}
+}
+
+func (b *PostgresBackend) fetchMissing(ctx context.Context, rec MissingRecord) error {
+	switch rec.Type {
+	case MissingRecordTypeProfile:
+		return b.fetchMissingProfile(ctx, rec.Identifier)
+	case MissingRecordTypePost:
+		return b.fetchMissingPost(ctx, rec.Identifier)
+	case MissingRecordTypeFeedGenerator:
+		return b.fetchMissingFeedGenerator(ctx, rec.Identifier)
+	default:
+		return fmt.Errorf("unknown missing record type %q", rec.Type)
+	}
+}
+
+// getRecordFromPDS fetches a record from the PDS hosting the repo. Only a
+// few fetches run against any one PDS at a time.
+func (b *PostgresBackend) getRecordFromPDS(ctx context.Context, did, collection, rkey string) (*atproto.RepoGetRecord_Output, error) {
+	resp, err := b.dir.LookupDID(ctx, syntax.DID(did))
+	if err != nil {
+		return nil, err
+	}
+
+	pds := resp.PDSEndpoint()
+	if pds == "" {
+		return nil, fmt.Errorf("no PDS endpoint for %s", did)
+	}
+
+	release, err := b.missing.acquirePDS(ctx, pds)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	c := &xrpclib.Client{
-		Host: resp.PDSEndpoint(),
+		Host: pds,
 	}
 
-	rec, err := atproto.RepoGetRecord(ctx, c, "", "app.bsky.actor.profile", did, "self")
+	return atproto.RepoGetRecord(ctx, c, "", collection, did, rkey)
+}
+
+func (mf *missingFetcher) acquirePDS(ctx context.Context, pds string) (func(), error) {
+	mf.pdsLk.Lock()
+	slots, ok := mf.pdsSlots[pds]
+	if !ok {
+		slots = make(chan struct{}, missingFetchPerPDS)
+		mf.pdsSlots[pds] = slots
+	}
+	mf.pdsLk.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *PostgresBackend) fetchMissingProfile(ctx context.Context, did string) error {
+	b.AddRelevantDid(did, RelevanceFetched)
+
+	repo, err := b.GetOrCreateRepo(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	rec, err := b.getRecordFromPDS(ctx, did, "app.bsky.actor.profile", "self")
 	if err != nil {
 		return err
 	}
@@ -110,7 +478,12 @@ func (b *PostgresBackend) fetchMissingProfile(ctx context.Context, did string) e
 		return err
 	}
 
-	return b.HandleUpdateProfile(ctx, repo, "self", "", buf.Bytes(), cc)
+	if err := b.HandleUpdateProfile(ctx, repo, "self", "", buf.Bytes(), cc); err != nil {
+		return err
+	}
+
+	b.recordChanged(did, "app.bsky.actor.profile", "self")
+	return nil
 }
 
 func (b *PostgresBackend) fetchMissingPost(ctx context.Context, uri string) error {
@@ -123,23 +496,14 @@ func (b *PostgresBackend) fetchMissingPost(ctx context.Context, uri string) erro
 	collection := puri.Collection().String()
 	rkey := puri.RecordKey().String()
 
-	b.AddRelevantDid(did)
+	b.AddRelevantDid(did, RelevanceFetched)
 
 	repo, err := b.GetOrCreateRepo(ctx, did)
 	if err != nil {
 		return err
 	}
 
-	resp, err := b.dir.LookupDID(ctx, syntax.DID(did))
-	if err != nil {
-		return err
-	}
-
-	c := &xrpclib.Client{
-		Host: resp.PDSEndpoint(),
-	}
-
-	rec, err := atproto.RepoGetRecord(ctx, c, "", collection, did, rkey)
+	rec, err := b.getRecordFromPDS(ctx, did, collection, rkey)
 	if err != nil {
 		return err
 	}
@@ -159,7 +523,12 @@ func (b *PostgresBackend) fetchMissingPost(ctx context.Context, uri string) erro
 		return err
 	}
 
-	return b.HandleCreatePost(ctx, repo, rkey, buf.Bytes(), cc)
+	if err := b.HandleCreatePost(ctx, repo, rkey, buf.Bytes(), cc); err != nil {
+		return err
+	}
+
+	b.recordChanged(did, collection, rkey)
+	return nil
 }
 
 func (b *PostgresBackend) fetchMissingFeedGenerator(ctx context.Context, uri string) error {
@@ -171,23 +540,14 @@ func (b *PostgresBackend) fetchMissingFeedGenerator(ctx context.Context, uri str
 	did := puri.Authority().String()
 	collection := puri.Collection().String()
 	rkey := puri.RecordKey().String()
-	b.AddRelevantDid(did)
+	b.AddRelevantDid(did, RelevanceFetched)
 
 	repo, err := b.GetOrCreateRepo(ctx, did)
 	if err != nil {
 		return err
 	}
 
-	resp, err := b.dir.LookupDID(ctx, syntax.DID(did))
-	if err != nil {
-		return err
-	}
-
-	c := &xrpclib.Client{
-		Host: resp.PDSEndpoint(),
-	}
-
-	rec, err := atproto.RepoGetRecord(ctx, c, "", collection, did, rkey)
+	rec, err := b.getRecordFromPDS(ctx, did, collection, rkey)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,162 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+type recordTable struct {
+	Collection string
+	Table      string
+
+	// Cond excludes placeholder rows that we create for records referenced
+	// by others but have not seen ourselves
+	Cond string
+}
+
+// tables holding records authored by a repo, used to reconcile our index
+// against a full copy of the repo
+var recordTables = []recordTable{
+	{Collection: "app.bsky.feed.post", Table: "posts", Cond: "raw IS NOT NULL AND length(raw) > 0"},
+	{Collection: "app.bsky.feed.like", Table: "likes"},
+	{Collection: "app.bsky.feed.repost", Table: "reposts"},
+	{Collection: "app.bsky.graph.follow", Table: "follows"},
+	{Collection: "app.bsky.graph.block", Table: "blocks"},
+	{Collection: "app.bsky.graph.list", Table: "lists", Cond: "raw IS NOT NULL AND length(raw) > 0"},
+	{Collection: "app.bsky.graph.listitem", Table: "list_items"},
+	{Collection: "app.bsky.graph.listblock", Table: "list_blocks"},
+	{Collection: "app.bsky.feed.generator", Table: "feed_generators", Cond: "raw IS NOT NULL AND length(raw) > 0"},
+	{Collection: "app.bsky.feed.threadgate", Table: "thread_gates"},
+	{Collection: "app.bsky.feed.postgate", Table: "post_gates"},
+	{Collection: "app.bsky.graph.starterpack", Table: "starter_packs"},
+}
+
+// indexedRecordPaths returns the repo paths (collection/rkey) of every record
+// we have indexed for the given repo.
+func (b *PostgresBackend) indexedRecordPaths(ctx context.Context, rr *Repo) (map[string]bool, error) {
+	out := make(map[string]bool)
+
+	for _, t := range recordTables {
+		q := "SELECT rkey FROM " + t.Table + " WHERE author = $1"
+		if t.Cond != "" {
+			q += " AND " + t.Cond
+		}
+
+		rows, err := b.pgx.Query(ctx, q, rr.ID)
+		if err != nil {
+			return nil, fmt.Errorf("loading indexed %s: %w", t.Table, err)
+		}
+
+		for rows.Next() {
+			var rkey string
+			if err := rows.Scan(&rkey); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			out[t.Collection+"/"+rkey] = true
+		}
+		rows.Close()
+
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := b.pgx.Query(ctx, "SELECT collection, rkey FROM records WHERE author = $1", rr.ID)
+	if err != nil {
+		return nil, fmt.Errorf("loading indexed records: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var col, rkey string
+		if err := rows.Scan(&col, &rkey); err != nil {
+			return nil, err
+		}
+		out[col+"/"+rkey] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var hasProfile bool
+	if err := b.pgx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM profiles WHERE repo = $1)", rr.ID).Scan(&hasProfile); err != nil {
+		return nil, err
+	}
+	if hasProfile {
+		out["app.bsky.actor.profile/self"] = true
+	}
+
+	return out, nil
+}
+
+// recordIndexed checks whether the record at path is still in our index.
+func (b *PostgresBackend) recordIndexed(ctx context.Context, rr *Repo, path string) (bool, error) {
+	col, rkey, ok := strings.Cut(path, "/")
+	if !ok {
+		return false, fmt.Errorf("invalid record path %q", path)
+	}
+
+	if col == "app.bsky.actor.profile" {
+		var exists bool
+		err := b.pgx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM profiles WHERE repo = $1)", rr.ID).Scan(&exists)
+		return exists, err
+	}
+
+	for _, t := range recordTables {
+		if t.Collection != col {
+			continue
+		}
+
+		q := "SELECT EXISTS (SELECT 1 FROM " + t.Table + " WHERE author = $1 AND rkey = $2"
+		if t.Cond != "" {
+			q += " AND " + t.Cond
+		}
+		q += ")"
+
+		var exists bool
+		err := b.pgx.QueryRow(ctx, q, rr.ID, rkey).Scan(&exists)
+		return exists, err
+	}
+
+	var exists bool
+	err := b.pgx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM records WHERE author = $1 AND collection = $2 AND rkey = $3)", rr.ID, col, rkey).Scan(&exists)
+	return exists, err
+}
+
+// removeStaleRecords deletes every indexed record that is not present in the
+// repo snapshot, returning the number of records removed. Deletes skip the
+// rev check, live events may have moved the repo past the snapshot rev.
+func (b *PostgresBackend) removeStaleRecords(ctx context.Context, rr *Repo, indexed, seen map[string]bool) (int64, error) {
+	var removed int64
+	for path := range indexed {
+		if seen[path] {
+			continue
+		}
+
+		// a live delete may have beaten us to it
+		exists, err := b.recordIndexed(ctx, rr, path)
+		if err != nil {
+			return removed, err
+		}
+		if !exists {
+			continue
+		}
+
+		if err := b.deleteRecord(ctx, rr, path); err != nil {
+			return removed, fmt.Errorf("failed to remove stale record %s: %w", path, err)
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		slog.Info("removed stale records", "did", rr.Did, "count", removed)
+	}
+
+	return removed, nil
+}
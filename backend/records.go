@@ -0,0 +1,57 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+// SetRecordCollections sets the collections whose records are kept in the
+// generic records table when konbini has no handler of its own for them.
+// Entries are NSIDs, or prefixes ending in ".*" such as "com.example.*". A
+// lone "*" stores every unhandled collection.
+func (b *PostgresBackend) SetRecordCollections(patterns []string) {
+	b.recordCollections = patterns
+}
+
+// StoresCollection returns true if records of the given collection are kept
+// in the generic records table.
+func (b *PostgresBackend) StoresCollection(col string) bool {
+	for _, p := range b.recordCollections {
+		if p == "*" || p == col {
+			return true
+		}
+
+		if prefix, ok := strings.CutSuffix(p, "*"); ok && strings.HasSuffix(prefix, ".") && strings.HasPrefix(col, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HandleCreateGenericRecord stores a record from a collection we don't model,
+// replacing any previous version of it.
+func (b *PostgresBackend) HandleCreateGenericRecord(ctx context.Context, repo *Repo, col, rkey string, recb []byte, cc cid.Cid) error {
+	if !b.anyRelevantIdents(repo.Did) {
+		return nil
+	}
+
+	if _, err := b.pgx.Exec(ctx, `INSERT INTO records (author, collection, rkey, cid, raw, indexed) VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (author, collection, rkey) DO UPDATE SET cid = $4, raw = $5, indexed = $6`, repo.ID, col, rkey, cc.String(), recb, time.Now()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (b *PostgresBackend) HandleDeleteGenericRecord(ctx context.Context, repo *Repo, col, rkey string) error {
+	if _, err := b.pgx.Exec(ctx, "DELETE FROM records WHERE author = $1 AND collection = $2 AND rkey = $3", repo.ID, col, rkey); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	. "github.com/whyrusleeping/konbini/models"
+	"gorm.io/gorm"
+)
+
+// RecordHandler indexes the records of a single collection that konbini
+// doesn't handle itself. Handlers run in the same pipeline as the built-in
+// ones: after the rev check, with the same metrics, and with access to the
+// backend's repo and post caches.
+type RecordHandler struct {
+	// Collection is the NSID of the records this handler indexes
+	Collection string
+
+	// Create indexes a new record
+	Create func(ctx context.Context, b *PostgresBackend, repo *Repo, rkey string, rec []byte, cc cid.Cid) error
+
+	// Update indexes a new version of a record. Optional, Create is used if
+	// it is nil.
+	Update func(ctx context.Context, b *PostgresBackend, repo *Repo, rkey string, rec []byte, cc cid.Cid) error
+
+	// Delete removes a record from the index
+	Delete func(ctx context.Context, b *PostgresBackend, repo *Repo, rkey string) error
+
+	// Migrate sets up the tables the handler needs. Optional, it is run
+	// once when the handler is registered.
+	Migrate func(db *gorm.DB) error
+
+	// Relevant decides whether a record should be indexed. Optional, by
+	// default records are indexed if their author is in the relevant set.
+	Relevant func(b *PostgresBackend, repo *Repo, rec []byte) bool
+}
+
+// RegisterRecordHandler adds a handler for a collection. It must be called
+// before events start flowing, and the collection can't be one konbini
+// already handles.
+func (b *PostgresBackend) RegisterRecordHandler(h RecordHandler) error {
+	if h.Collection == "" || h.Create == nil || h.Delete == nil {
+		return fmt.Errorf("record handler needs a collection and create and delete callbacks")
+	}
+
+	if builtinCollections[h.Collection] {
+		return fmt.Errorf("collection %s is handled by konbini itself", h.Collection)
+	}
+
+	b.handlersLk.Lock()
+	defer b.handlersLk.Unlock()
+
+	if _, ok := b.handlers[h.Collection]; ok {
+		return fmt.Errorf("collection %s already has a handler", h.Collection)
+	}
+
+	if h.Migrate != nil {
+		if err := h.Migrate(b.db); err != nil {
+			return fmt.Errorf("migrating for %s: %w", h.Collection, err)
+		}
+	}
+
+	b.handlers[h.Collection] = &h
+	return nil
+}
+
+// DB returns the gorm handle of the backend, for record handlers
+func (b *PostgresBackend) DB() *gorm.DB {
+	return b.db
+}
+
+// Pool returns the pgx pool of the backend, for record handlers
+func (b *PostgresBackend) Pool() *pgxpool.Pool {
+	return b.pgx
+}
+
+func (b *PostgresBackend) recordHandler(col string) *RecordHandler {
+	b.handlersLk.RLock()
+	defer b.handlersLk.RUnlock()
+
+	return b.handlers[col]
+}
+
+// collections with handling in events.go
+var builtinCollections = map[string]bool{
+	"app.bsky.feed.post":          true,
+	"app.bsky.feed.like":          true,
+	"app.bsky.feed.repost":        true,
+	"app.bsky.graph.follow":       true,
+	"app.bsky.graph.block":        true,
+	"app.bsky.graph.list":         true,
+	"app.bsky.graph.listitem":     true,
+	"app.bsky.graph.listblock":    true,
+	"app.bsky.actor.profile":      true,
+	"app.bsky.feed.generator":     true,
+	"app.bsky.feed.threadgate":    true,
+	"chat.bsky.actor.declaration": true,
+	"app.bsky.feed.postgate":      true,
+	"app.bsky.graph.starterpack":  true,
+}
+
+func (h *RecordHandler) relevant(b *PostgresBackend, repo *Repo, rec []byte) bool {
+	if h.Relevant != nil {
+		return h.Relevant(b, repo, rec)
+	}
+
+	return b.DidIsRelevant(repo.Did)
+}
+
+func (h *RecordHandler) create(ctx context.Context, b *PostgresBackend, repo *Repo, rkey string, rec []byte, cc cid.Cid) error {
+	if !h.relevant(b, repo, rec) {
+		return nil
+	}
+
+	return h.Create(ctx, b, repo, rkey, rec, cc)
+}
+
+func (h *RecordHandler) update(ctx context.Context, b *PostgresBackend, repo *Repo, rkey string, rec []byte, cc cid.Cid) error {
+	if !h.relevant(b, repo, rec) {
+		return nil
+	}
+
+	if h.Update != nil {
+		return h.Update(ctx, b, repo, rkey, rec, cc)
+	}
+	return h.Create(ctx, b, repo, rkey, rec, cc)
+}
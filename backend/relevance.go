@@ -0,0 +1,526 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+// Reasons a DID can be in the relevant set. A DID may be relevant for more
+// than one reason, it is dropped once it has none left.
+const (
+	RelevanceSelf         = "self"
+	RelevanceFollow       = "follow"
+	RelevanceSecondDegree = "second-degree"
+	RelevanceManual       = "manual"
+	RelevanceFetched      = "fetched"
+	RelevanceMention      = "mention"
+)
+
+// RelevanceReason is a single reason a DID is relevant. Reasons derived from a
+// local user's follow graph (self, follow and second-degree) name that user,
+// the others apply to the whole instance and have an empty User.
+type RelevanceReason struct {
+	Reason string `json:"reason"`
+	User   string `json:"user,omitempty"`
+}
+
+type RelevanceConfig struct {
+	// Depth is how far out the follow graph we consider accounts relevant.
+	// 1 only includes our own follows, 2 adds the follows of our follows.
+	Depth int
+
+	// MinMutuals is the number of our follows that must follow a second
+	// degree account for it to be included
+	MinMutuals int
+
+	// MaxSecondDegree caps the number of second degree accounts, the ones
+	// followed by the most of our follows win. The cap applies to each local
+	// user separately.
+	MaxSecondDegree int
+
+	// RecomputeInterval is how often the graph derived reasons are fully
+	// recomputed. Follow changes are applied incrementally in between.
+	RecomputeInterval time.Duration
+}
+
+var relevantDidsPersistFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "relevant_dids_persist_failures",
+	Help: "Number of relevant set changes that failed to be written to the database",
+})
+
+type relevanceChange struct {
+	Did string
+	RelevanceReason
+	Add bool
+}
+
+// AddRelevantDid marks a DID as relevant for the given instance wide reason.
+func (b *PostgresBackend) AddRelevantDid(did, reason string) {
+	b.rdLk.Lock()
+	b.addRelevantLk(did, RelevanceReason{Reason: reason})
+	b.rdLk.Unlock()
+
+	b.flushRelevance(context.TODO())
+}
+
+// addRelevantLk and removeRelevantLk update the in-memory set and queue the
+// change to be written out by flushRelevance once the lock is released.
+func (b *PostgresBackend) addRelevantLk(did string, r RelevanceReason) {
+	reasons, ok := b.relevantDids[did]
+	if !ok {
+		reasons = make(map[RelevanceReason]bool)
+		b.relevantDids[did] = reasons
+	}
+
+	if reasons[r] {
+		return
+	}
+
+	reasons[r] = true
+	if r.Reason == RelevanceSecondDegree {
+		b.secondDegreeCount[r.User]++
+	}
+	b.relChanges = append(b.relChanges, relevanceChange{Did: did, RelevanceReason: r, Add: true})
+}
+
+func (b *PostgresBackend) removeRelevantLk(did string, r RelevanceReason) {
+	reasons, ok := b.relevantDids[did]
+	if !ok || !reasons[r] {
+		return
+	}
+
+	delete(reasons, r)
+	if r.Reason == RelevanceSecondDegree {
+		b.secondDegreeCount[r.User]--
+	}
+	b.relChanges = append(b.relChanges, relevanceChange{Did: did, RelevanceReason: r})
+
+	if len(reasons) == 0 && !b.pinnedDids[did] {
+		delete(b.relevantDids, did)
+	}
+}
+
+// flushRelevance writes queued relevant set changes to the database.
+func (b *PostgresBackend) flushRelevance(ctx context.Context) {
+	b.rdLk.Lock()
+	changes := b.relChanges
+	b.relChanges = nil
+	b.rdLk.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+
+	now := time.Now()
+	batch := &pgx.Batch{}
+	for _, c := range changes {
+		if c.Add {
+			batch.Queue("INSERT INTO relevant_dids (did, reason, local_user, pinned, created_at, updated_at) VALUES ($1, $2, $3, false, $4, $4) ON CONFLICT (did, reason, local_user) DO UPDATE SET updated_at = $4", c.Did, c.Reason, c.User, now)
+		} else {
+			batch.Queue("DELETE FROM relevant_dids WHERE did = $1 AND reason = $2 AND local_user = $3", c.Did, c.Reason, c.User)
+		}
+	}
+
+	if err := b.pgx.SendBatch(ctx, batch).Close(); err != nil {
+		// the in-memory set is still correct, the table catches up on the
+		// next recompute
+		relevantDidsPersistFailures.Add(float64(len(changes)))
+		slog.Error("failed to persist relevant dids", "changes", len(changes), "error", err)
+	}
+}
+
+// loadRelevantDidsTable fills the in-memory set from the relevant_dids table.
+func (b *PostgresBackend) loadRelevantDidsTable(ctx context.Context) error {
+	rows, err := b.pgx.Query(ctx, "SELECT did, reason, local_user, pinned FROM relevant_dids")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	b.rdLk.Lock()
+	defer b.rdLk.Unlock()
+
+	for rows.Next() {
+		var did string
+		var r RelevanceReason
+		var pinned bool
+		if err := rows.Scan(&did, &r.Reason, &r.User, &pinned); err != nil {
+			return err
+		}
+
+		reasons, ok := b.relevantDids[did]
+		if !ok {
+			reasons = make(map[RelevanceReason]bool)
+			b.relevantDids[did] = reasons
+		}
+		if !reasons[r] && r.Reason == RelevanceSecondDegree {
+			b.secondDegreeCount[r.User]++
+		}
+		reasons[r] = true
+
+		if pinned {
+			b.pinnedDids[did] = true
+		}
+	}
+
+	return rows.Err()
+}
+
+// RelevanceReasons returns the reasons the given DID is relevant, or nil if
+// it is not.
+func (b *PostgresBackend) RelevanceReasons(did string) []RelevanceReason {
+	b.rdLk.Lock()
+	defer b.rdLk.Unlock()
+
+	return sortedReasons(b.relevantDids[did])
+}
+
+// GetRelevantDidReasons returns every relevant DID along with the reasons it
+// is relevant.
+func (b *PostgresBackend) GetRelevantDidReasons() map[string][]RelevanceReason {
+	b.rdLk.Lock()
+	defer b.rdLk.Unlock()
+
+	out := make(map[string][]RelevanceReason, len(b.relevantDids))
+	for did, reasons := range b.relevantDids {
+		out[did] = sortedReasons(reasons)
+	}
+	return out
+}
+
+func sortedReasons(reasons map[RelevanceReason]bool) []RelevanceReason {
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	out := make([]RelevanceReason, 0, len(reasons))
+	for r := range reasons {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Reason != out[j].Reason {
+			return out[i].Reason < out[j].Reason
+		}
+		return out[i].User < out[j].User
+	})
+	return out
+}
+
+// graphUsers returns the local users whose own follow graph includes the DID,
+// meaning its follows feed into their second degree set.
+func (b *PostgresBackend) graphUsers(did string) []string {
+	b.rdLk.Lock()
+	defer b.rdLk.Unlock()
+
+	var users []string
+	for r := range b.relevantDids[did] {
+		if r.Reason == RelevanceSelf || r.Reason == RelevanceFollow {
+			users = append(users, r.User)
+		}
+	}
+	return users
+}
+
+func (b *PostgresBackend) runRelevanceRecompute(ctx context.Context) {
+	interval := b.relCfg.RecomputeInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := b.recomputeRelevance(ctx); err != nil {
+			slog.Error("failed to recompute relevant dids", "error", err)
+		}
+	}
+}
+
+// recomputeRelevance rebuilds the follow graph derived reasons of every local
+// user. Reasons that don't come from the follow graph are left untouched.
+func (b *PostgresBackend) recomputeRelevance(ctx context.Context) error {
+	for _, u := range b.LocalUsers() {
+		if err := b.recomputeUserRelevance(ctx, u); err != nil {
+			return fmt.Errorf("recomputing relevance for %s: %w", u.Did, err)
+		}
+	}
+
+	return nil
+}
+
+// recomputeUserRelevance rebuilds the self, follow and second-degree reasons
+// of a single local user from the follows table.
+func (b *PostgresBackend) recomputeUserRelevance(ctx context.Context, u *LocalUser) error {
+	start := time.Now()
+
+	var follows []string
+	if err := b.db.Raw("select did from follows left join repos on follows.subject = repos.id where follows.author = ?", u.Repo).Scan(&follows).Error; err != nil {
+		return err
+	}
+
+	var second []string
+	if b.relCfg.Depth >= 2 {
+		minMutuals := b.relCfg.MinMutuals
+		if minMutuals < 1 {
+			minMutuals = 1
+		}
+
+		// a NULL limit means no limit
+		var limit any
+		if b.relCfg.MaxSecondDegree > 0 {
+			limit = b.relCfg.MaxSecondDegree
+		}
+
+		// accounts followed by at least minMutuals of the user's follows,
+		// that the user doesn't already follow
+		if err := b.db.Raw(`SELECT r.did FROM follows f1
+JOIN follows f2 ON f2.author = f1.subject
+JOIN repos r ON r.id = f2.subject
+WHERE f1.author = ?
+AND f2.subject != ?
+AND f2.subject NOT IN (SELECT subject FROM follows WHERE author = ?)
+GROUP BY r.did
+HAVING count(DISTINCT f2.author) >= ?
+ORDER BY count(DISTINCT f2.author) DESC
+LIMIT ?`, u.Repo, u.Repo, u.Repo, minMutuals, limit).Scan(&second).Error; err != nil {
+			return fmt.Errorf("failed to compute second degree follows: %w", err)
+		}
+	}
+
+	b.rdLk.Lock()
+	b.replaceReasonLk(RelevanceReason{Reason: RelevanceFollow, User: u.Did}, follows)
+	b.replaceReasonLk(RelevanceReason{Reason: RelevanceSecondDegree, User: u.Did}, second)
+	b.addRelevantLk(u.Did, RelevanceReason{Reason: RelevanceSelf, User: u.Did})
+	total := len(b.relevantDids)
+	b.rdLk.Unlock()
+
+	b.flushRelevance(ctx)
+
+	slog.Info("recomputed relevant dids", "user", u.Did, "follows", len(follows), "secondDegree", len(second), "total", total, "took", time.Since(start))
+	return nil
+}
+
+// replaceReasonLk makes dids the exact set of DIDs relevant for the given
+// reason.
+func (b *PostgresBackend) replaceReasonLk(r RelevanceReason, dids []string) {
+	next := make(map[string]bool, len(dids))
+	for _, d := range dids {
+		next[d] = true
+	}
+
+	for did, reasons := range b.relevantDids {
+		if reasons[r] && !next[did] {
+			b.removeRelevantLk(did, r)
+		}
+	}
+
+	for did := range next {
+		b.addRelevantLk(did, r)
+	}
+}
+
+// handleLocalFollow updates the relevant set right away when a local user
+// follows someone, rather than waiting for the next recompute, and backfills
+// the newly followed account. Its own follows feed into the user's second
+// degree set as the backfill indexes them.
+func (b *PostgresBackend) handleLocalFollow(ctx context.Context, u *LocalUser, subject string) {
+	b.rdLk.Lock()
+	_, already := b.relevantDids[subject]
+	b.addRelevantLk(subject, RelevanceReason{Reason: RelevanceFollow, User: u.Did})
+	b.removeRelevantLk(subject, RelevanceReason{Reason: RelevanceSecondDegree, User: u.Did})
+	b.rdLk.Unlock()
+
+	b.flushRelevance(ctx)
+
+	// someone else on this instance already made it relevant, so we are
+	// already indexing it
+	if already {
+		return
+	}
+
+	if _, err := b.EnqueueBackfill(ctx, subject, "follow"); err != nil {
+		slog.Warn("failed to enqueue backfill for new follow", "did", subject, "error", err)
+	}
+}
+
+// handleLocalUnfollow drops the follow reason for an account a local user
+// unfollowed. Accounts that are still reachable through the user's follows
+// stay in the set as second degree accounts. Second degree accounts that were
+// only reachable through the unfollowed account are dropped on the next full
+// recompute.
+func (b *PostgresBackend) handleLocalUnfollow(ctx context.Context, u *LocalUser, subject *Repo) error {
+	// there may be more than one follow record for the same account
+	var stillFollowing bool
+	if err := b.pgx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM follows WHERE author = $1 AND subject = $2)", u.Repo, subject.ID).Scan(&stillFollowing); err != nil {
+		return err
+	}
+	if stillFollowing {
+		return nil
+	}
+
+	b.rdLk.Lock()
+	b.removeRelevantLk(subject.Did, RelevanceReason{Reason: RelevanceFollow, User: u.Did})
+	b.rdLk.Unlock()
+
+	return b.updateSecondDegree(ctx, u, subject)
+}
+
+// followGraphChanged is called when an account followed or unfollowed
+// subject. If the account is in some local user's follow graph, subject is
+// re-evaluated against that user's second degree rules.
+func (b *PostgresBackend) followGraphChanged(ctx context.Context, author string, subject *Repo) error {
+	if b.relCfg.Depth < 2 {
+		return nil
+	}
+
+	for _, did := range b.graphUsers(author) {
+		u := b.localUser(did)
+		if u == nil {
+			continue
+		}
+
+		if err := b.updateSecondDegree(ctx, u, subject); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateSecondDegree re-evaluates a single account against a local user's
+// second degree rules after one of their follows followed or unfollowed it.
+// This keeps the set current between full recomputes without rerunning the
+// whole follow graph query for every follow event.
+func (b *PostgresBackend) updateSecondDegree(ctx context.Context, u *LocalUser, subject *Repo) error {
+	if b.relCfg.Depth < 2 || subject.ID == u.Repo {
+		return nil
+	}
+
+	follow := RelevanceReason{Reason: RelevanceFollow, User: u.Did}
+	second := RelevanceReason{Reason: RelevanceSecondDegree, User: u.Did}
+
+	b.rdLk.Lock()
+	following := b.relevantDids[subject.Did][follow]
+	b.rdLk.Unlock()
+
+	if following {
+		return nil
+	}
+
+	var mutuals int
+	if err := b.pgx.QueryRow(ctx, `SELECT count(DISTINCT f2.author) FROM follows f1
+JOIN follows f2 ON f2.author = f1.subject
+WHERE f1.author = $1 AND f2.subject = $2`, u.Repo, subject.ID).Scan(&mutuals); err != nil {
+		return err
+	}
+
+	b.rdLk.Lock()
+	if mutuals < max(b.relCfg.MinMutuals, 1) {
+		b.removeRelevantLk(subject.Did, second)
+	} else if b.relCfg.MaxSecondDegree <= 0 || b.secondDegreeCount[u.Did] < b.relCfg.MaxSecondDegree {
+		// once the cap is reached, the next full recompute decides which
+		// accounts make the cut
+		b.addRelevantLk(subject.Did, second)
+	}
+	b.rdLk.Unlock()
+
+	b.flushRelevance(ctx)
+	return nil
+}
+
+// relevance reasons derived from the follow graph, these are recomputed
+// automatically and can't be removed by hand
+func isGraphReason(reason string) bool {
+	return reason == RelevanceSelf || reason == RelevanceFollow || reason == RelevanceSecondDegree
+}
+
+// ListRelevantDids returns entries from the relevant_dids table, optionally
+// filtered by reason and local user.
+func (b *PostgresBackend) ListRelevantDids(ctx context.Context, reason, user string, limit, offset int) ([]RelevantDid, error) {
+	q := b.db.Order("did ASC, reason ASC, local_user ASC").Limit(limit).Offset(offset)
+	if reason != "" {
+		q = q.Where("reason = ?", reason)
+	}
+	if user != "" {
+		q = q.Where("local_user = ?", user)
+	}
+
+	var out []RelevantDid
+	if err := q.Find(&out).Error; err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// RemoveRelevantDid unpins a DID and drops the reasons that weren't derived
+// from the follow graph. The remaining reasons are returned.
+func (b *PostgresBackend) RemoveRelevantDid(ctx context.Context, did string) ([]RelevanceReason, error) {
+	if _, err := b.pgx.Exec(ctx, "UPDATE relevant_dids SET pinned = false, updated_at = NOW() WHERE did = $1", did); err != nil {
+		return nil, err
+	}
+
+	b.rdLk.Lock()
+	delete(b.pinnedDids, did)
+	for _, r := range sortedReasons(b.relevantDids[did]) {
+		if !isGraphReason(r.Reason) {
+			b.removeRelevantLk(did, r)
+		}
+	}
+	// an unpinned DID with no reasons left may still be sitting in the map
+	if reasons, ok := b.relevantDids[did]; ok && len(reasons) == 0 {
+		delete(b.relevantDids, did)
+	}
+	remaining := sortedReasons(b.relevantDids[did])
+	b.rdLk.Unlock()
+
+	b.flushRelevance(ctx)
+	return remaining, nil
+}
+
+// SetRelevantDidPinned pins or unpins a DID. Pinned DIDs carry a manual
+// reason, which is never dropped automatically, so they stay in the set until
+// they are unpinned and removed.
+func (b *PostgresBackend) SetRelevantDidPinned(ctx context.Context, did string, pinned bool) error {
+	if pinned {
+		b.AddRelevantDid(did, RelevanceManual)
+
+		if _, err := b.pgx.Exec(ctx, "UPDATE relevant_dids SET pinned = true, updated_at = NOW() WHERE did = $1 AND reason = $2 AND local_user = ''", did, RelevanceManual); err != nil {
+			return err
+		}
+	} else {
+		if _, err := b.pgx.Exec(ctx, "UPDATE relevant_dids SET pinned = false, updated_at = NOW() WHERE did = $1", did); err != nil {
+			return err
+		}
+	}
+
+	b.rdLk.Lock()
+	defer b.rdLk.Unlock()
+
+	if pinned {
+		b.pinnedDids[did] = true
+		return nil
+	}
+
+	delete(b.pinnedDids, did)
+	if reasons, ok := b.relevantDids[did]; ok && len(reasons) == 0 {
+		delete(b.relevantDids, did)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/repo"
+	"github.com/ipfs/go-cid"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+var resyncCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "repo_resyncs",
+	Help: "Number of repo resyncs triggered, by reason",
+}, []string{"reason"})
+
+// EnqueueResync schedules a full re-fetch of the given repo through the
+// backfill job queue, so it survives restarts and is retried on failure.
+func (b *PostgresBackend) EnqueueResync(did, reason string) {
+	resyncCounter.WithLabelValues(reason).Inc()
+
+	if _, err := b.EnqueueBackfill(context.TODO(), did, "resync-"+reason); err != nil {
+		slog.Error("failed to enqueue resync", "did", did, "reason", reason, "error", err)
+	}
+}
+
+// HandleSyncEvent processes a #sync event, which signals that the repo's
+// state may have changed in ways not covered by commit events.
+func (b *PostgresBackend) HandleSyncEvent(ctx context.Context, evt *atproto.SyncSubscribeRepos_Sync) error {
+	if !b.DidIsRelevant(evt.Did) {
+		return nil
+	}
+
+	rr, err := b.GetOrCreateRepo(ctx, evt.Did)
+	if err != nil {
+		return err
+	}
+
+	lrev, err := b.revForRepo(rr)
+	if err != nil {
+		return err
+	}
+
+	if lrev != "" && evt.Rev <= lrev {
+		return nil
+	}
+
+	b.EnqueueResync(evt.Did, "sync")
+	return nil
+}
+
+// checkRevGap compares an incoming commit against the last rev we processed
+// for the repo, and schedules a resync if events were missed.
+func (b *PostgresBackend) checkRevGap(ctx context.Context, evt *atproto.SyncSubscribeRepos_Commit) error {
+	if evt.TooBig {
+		b.EnqueueResync(evt.Repo, "toobig")
+		return nil
+	}
+
+	if evt.Since == nil {
+		return nil
+	}
+
+	rr, err := b.GetOrCreateRepo(ctx, evt.Repo)
+	if err != nil {
+		return err
+	}
+
+	lrev, err := b.revForRepo(rr)
+	if err != nil {
+		return err
+	}
+
+	// we have no record of this repo yet, nothing to compare against
+	if lrev == "" {
+		return nil
+	}
+
+	if *evt.Since > lrev {
+		slog.Info("detected gap in repo revisions", "did", evt.Repo, "since", *evt.Since, "rev", lrev)
+		b.EnqueueResync(evt.Repo, "gap")
+	}
+
+	return nil
+}
+
+// setRepoRev records the latest rev we have fully processed for a repo, and
+// the MST root of the commit at that rev.
+func (b *PostgresBackend) setRepoRev(ctx context.Context, rr *Repo, rev, data string) error {
+	res, err := b.pgx.Exec(ctx, "UPDATE sync_infos SET rev = $1, data = $3 WHERE repo = $2 AND (rev IS NULL OR rev < $1)", rev, rr.ID, data)
+	if err != nil {
+		return fmt.Errorf("failed to update rev: %w", err)
+	}
+
+	if res.RowsAffected() == 0 {
+		if _, err := b.pgx.Exec(ctx, "INSERT INTO sync_infos (repo, follows_synced, rev, data) SELECT $1, false, $2, $3 WHERE NOT EXISTS (SELECT 1 FROM sync_infos WHERE repo = $1)", rr.ID, rev, data); err != nil {
+			return fmt.Errorf("failed to insert rev: %w", err)
+		}
+	}
+
+	if cur, ok := b.revCache.Get(rr.ID); !ok || cur < rev {
+		b.revCache.Add(rr.ID, rev)
+	}
+	return nil
+}
+
+// repoSyncState returns the last rev and MST root we processed for a repo,
+// both empty if we have none.
+func (b *PostgresBackend) repoSyncState(ctx context.Context, did string) (string, string, error) {
+	var rev, data string
+	if err := b.pgx.QueryRow(ctx, "SELECT COALESCE(s.rev, ''), COALESCE(s.data, '') FROM sync_infos s JOIN repos r ON r.id = s.repo WHERE r.did = $1", did).Scan(&rev, &data); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+
+	return rev, data, nil
+}
+
+// SyncRepo fetches a full copy of the repo from its PDS, indexes every record
+// in it and removes indexed records that are no longer in the repo.
+func (b *PostgresBackend) SyncRepo(ctx context.Context, did string) error {
+	_, err := b.syncRepo(ctx, did, nil)
+	return err
+}
+
+type syncStats struct {
+	Records int64
+	Bytes   int64
+	Rev     string
+
+	// records that were not indexed before, and indexed records that were
+	// no longer present in the repo
+	Added   int64
+	Removed int64
+}
+
+// repo fetches are bounded so a PDS that stops responding can't hold a
+// backfill worker forever
+var repoFetchClient = &http.Client{
+	Timeout: time.Minute * 10,
+}
+
+// how often (in records) the progress callback of syncRepo is invoked
+const syncProgressInterval = 500
+
+func (b *PostgresBackend) syncRepo(ctx context.Context, did string, progress func(syncStats)) (*syncStats, error) {
+	ident, err := b.dir.LookupDID(ctx, syntax.DID(did))
+	if err != nil {
+		return nil, err
+	}
+
+	pds := ident.PDSEndpoint()
+	if pds == "" {
+		return nil, fmt.Errorf("no PDS endpoint for %s", did)
+	}
+
+	rr, err := b.GetOrCreateRepo(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	// load this before fetching so records indexed from live events while
+	// we are syncing aren't mistaken for stale ones
+	indexed, err := b.indexedRecordPaths(ctx, rr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.waitForPDS(ctx, pds); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pds+"/xrpc/com.atproto.sync.getRepo?did="+url.QueryEscape(did), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "konbini/0.0.1")
+	req.Header.Set("Accept", "application/vnd.ipld.car")
+
+	resp, err := repoFetchClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch repo: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch repo: status %d", resp.StatusCode)
+	}
+
+	// the whole repo ends up in an in-memory blockstore, the counting reader
+	// just tells us how much we pulled from the PDS
+	cr := &countingReader{r: resp.Body}
+	rep, err := repo.ReadRepoFromCar(ctx, cr)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &syncStats{
+		Bytes: cr.n,
+		Rev:   rep.SignedCommit().Rev,
+	}
+
+	seen := make(map[string]bool)
+
+	if err := rep.ForEach(ctx, "", func(k string, v cid.Cid) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// mark the path before fetching the block, a record whose block is
+		// missing from the CAR still exists and must not be reconciled away
+		seen[k] = true
+
+		blk, err := rep.Blockstore().Get(ctx, v)
+		if err != nil {
+			slog.Error("record missing in repo", "path", k, "cid", v, "error", err)
+			return nil
+		}
+
+		if !indexed[k] {
+			stats.Added++
+		}
+
+		d := blk.RawData()
+		// live events may already have moved the repo past the snapshot
+		// rev, so skip the rev check HandleCreate would do
+		if err := b.createRecord(ctx, rr, stats.Rev, k, &d, &v); err != nil {
+			slog.Error("failed to index record", "path", k, "cid", v, "error", err)
+		}
+
+		stats.Records++
+		if progress != nil && stats.Records%syncProgressInterval == 0 {
+			progress(*stats)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	removed, err := b.removeStaleRecords(ctx, rr, indexed, seen)
+	if err != nil {
+		return nil, err
+	}
+	stats.Removed = removed
+
+	if err := b.setRepoRev(ctx, rr, stats.Rev, rep.SignedCommit().Data.String()); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (b *PostgresBackend) setPDSRate(perSecond float64) {
+	b.pdsLimLk.Lock()
+	defer b.pdsLimLk.Unlock()
+
+	if perSecond <= 0 {
+		b.pdsRate = rate.Inf
+	} else {
+		b.pdsRate = rate.Limit(perSecond)
+	}
+	b.pdsLimiters = make(map[string]*rate.Limiter)
+}
+
+// waitForPDS blocks until we are allowed to make another repo fetch against
+// the given PDS.
+func (b *PostgresBackend) waitForPDS(ctx context.Context, pds string) error {
+	b.pdsLimLk.Lock()
+	lim, ok := b.pdsLimiters[pds]
+	if !ok {
+		lim = rate.NewLimiter(b.pdsRate, 1)
+		b.pdsLimiters[pds] = lim
+	}
+	b.pdsLimLk.Unlock()
+
+	return lim.Wait(ctx)
+}
@@ -0,0 +1,322 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+// Actor search runs over actor_searches, which holds the handle, display
+// name and description of every account we have a profile for. Handles only
+// live in DID documents, so they are copied in when the profile is indexed
+// and kept current from identity events. The trigram and full text indexes
+// over it are created in main.
+
+// indexActorSearch updates the search entry of an account from its profile
+// record.
+func (b *PostgresBackend) indexActorSearch(ctx context.Context, repo *Repo, recb []byte) error {
+	var prof bsky.ActorProfile
+	if err := prof.UnmarshalCBOR(bytes.NewReader(recb)); err != nil {
+		return fmt.Errorf("decoding profile: %w", err)
+	}
+
+	return upsertActorSearch(ctx, b.pgx, repo.ID, searchHandle(ctx, b.dir, repo.Did), &prof)
+}
+
+// searchHandle returns the handle to index for an account, or an empty
+// string if it doesn't have a valid one.
+func searchHandle(ctx context.Context, dir identity.Directory, did string) string {
+	ident, err := dir.LookupDID(ctx, syntax.DID(did))
+	if err != nil {
+		slog.Warn("failed to resolve handle for search index", "did", did, "error", err)
+		return ""
+	}
+
+	if ident.Handle == syntax.HandleInvalid {
+		return ""
+	}
+
+	return ident.Handle.Normalize().String()
+}
+
+func upsertActorSearch(ctx context.Context, db *pgxpool.Pool, rid uint, handle string, prof *bsky.ActorProfile) error {
+	var displayName, description string
+	if prof.DisplayName != nil {
+		displayName = *prof.DisplayName
+	}
+	if prof.Description != nil {
+		description = *prof.Description
+	}
+
+	// keep the handle we have if it couldn't be resolved this time
+	if _, err := db.Exec(ctx, `INSERT INTO actor_searches (repo, handle, display_name, description, updated_at)
+VALUES ($1, $2, $3, $4, NOW())
+ON CONFLICT (repo) DO UPDATE SET
+	handle = CASE WHEN EXCLUDED.handle != '' THEN EXCLUDED.handle ELSE actor_searches.handle END,
+	display_name = EXCLUDED.display_name,
+	description = EXCLUDED.description,
+	updated_at = EXCLUDED.updated_at`, rid, handle, displayName, description); err != nil {
+		return fmt.Errorf("updating search entry: %w", err)
+	}
+
+	return nil
+}
+
+// updateSearchHandle records the current handle of an account after an
+// identity event. Accounts without a search entry are left alone, they get
+// one once their profile is indexed.
+func (b *PostgresBackend) updateSearchHandle(ctx context.Context, rid uint, handle syntax.Handle) error {
+	h := ""
+	if handle != syntax.HandleInvalid {
+		h = handle.Normalize().String()
+	}
+
+	if _, err := b.pgx.Exec(ctx, "UPDATE actor_searches SET handle = $2, updated_at = NOW() WHERE repo = $1", rid, h); err != nil {
+		return fmt.Errorf("updating search handle: %w", err)
+	}
+
+	return nil
+}
+
+func (b *PostgresBackend) removeActorSearch(ctx context.Context, rid uint) error {
+	if _, err := b.pgx.Exec(ctx, "DELETE FROM actor_searches WHERE repo = $1", rid); err != nil {
+		return fmt.Errorf("removing search entry: %w", err)
+	}
+
+	return nil
+}
+
+const reindexBatchSize = 1000
+
+// ReindexActorSearch rebuilds the actor search entries from the indexed
+// profiles, for profiles indexed before search existed. Handles are resolved
+// through dir.
+func ReindexActorSearch(ctx context.Context, pool *pgxpool.Pool, dir identity.Directory) error {
+	type profileRow struct {
+		Repo uint
+		Did  string
+		Raw  []byte
+	}
+
+	var last uint
+	var total int
+	for {
+		// accounts can have more than one profile row, the newest one wins
+		rows, err := pool.Query(ctx, `SELECT DISTINCT ON (p.repo) p.repo, r.did, p.raw
+FROM profiles p
+JOIN repos r ON r.id = p.repo
+WHERE p.repo > $1
+ORDER BY p.repo, p.id DESC
+LIMIT $2`, last, reindexBatchSize)
+		if err != nil {
+			return fmt.Errorf("loading profiles: %w", err)
+		}
+
+		profiles, err := pgx.CollectRows(rows, pgx.RowToStructByPos[profileRow])
+		if err != nil {
+			return fmt.Errorf("loading profiles: %w", err)
+		}
+
+		if len(profiles) == 0 {
+			break
+		}
+
+		for _, p := range profiles {
+			var prof bsky.ActorProfile
+			if err := prof.UnmarshalCBOR(bytes.NewReader(p.Raw)); err != nil {
+				slog.Warn("skipping undecodable profile", "did", p.Did, "error", err)
+				continue
+			}
+
+			if err := upsertActorSearch(ctx, pool, p.Repo, searchHandle(ctx, dir, p.Did), &prof); err != nil {
+				return err
+			}
+		}
+
+		last = profiles[len(profiles)-1].Repo
+		total += len(profiles)
+		slog.Info("reindexing actor search", "done", total, "last_repo", last)
+	}
+
+	return nil
+}
+
+// Post search runs over post_searches, which has a row for every indexed post
+// with its text and the things searchPosts can filter on pulled out of the
+// record. Rows are written in the same transaction as the post.
+
+// indexPostSearch writes the search entry of a post.
+func indexPostSearch(ctx context.Context, tx pgx.Tx, p *Post, rec *bsky.FeedPost) error {
+	var tags, mentions, urls, domains, langs []string
+	seen := make(map[string]bool)
+	add := func(list *[]string, kind, v string) {
+		if v == "" || seen[kind+v] {
+			return
+		}
+		seen[kind+v] = true
+		*list = append(*list, v)
+	}
+
+	addURL := func(u string) {
+		add(&urls, "url", NormalizeSearchURL(u))
+		if pu, err := url.Parse(u); err == nil {
+			add(&domains, "domain", NormalizeSearchDomain(pu.Hostname()))
+		}
+	}
+
+	for _, t := range rec.Tags {
+		add(&tags, "tag", NormalizeSearchTag(t))
+	}
+
+	for _, facet := range rec.Facets {
+		for _, feature := range facet.Features {
+			switch {
+			case feature.RichtextFacet_Mention != nil:
+				add(&mentions, "mention", feature.RichtextFacet_Mention.Did)
+			case feature.RichtextFacet_Link != nil:
+				addURL(feature.RichtextFacet_Link.Uri)
+			case feature.RichtextFacet_Tag != nil:
+				add(&tags, "tag", NormalizeSearchTag(feature.RichtextFacet_Tag.Tag))
+			}
+		}
+	}
+
+	if ext := postExternalEmbed(rec); ext != nil {
+		addURL(ext.Uri)
+	}
+
+	for _, l := range rec.Langs {
+		add(&langs, "lang", NormalizeSearchLang(l))
+	}
+
+	if _, err := tx.Exec(ctx, `INSERT INTO post_searches (post, author, created, text, tags, mentions, urls, domains, langs)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (post) DO UPDATE SET
+	created = EXCLUDED.created,
+	text = EXCLUDED.text,
+	tags = EXCLUDED.tags,
+	mentions = EXCLUDED.mentions,
+	urls = EXCLUDED.urls,
+	domains = EXCLUDED.domains,
+	langs = EXCLUDED.langs`, p.ID, p.Author, p.Created, rec.Text, tags, mentions, urls, domains, langs); err != nil {
+		return fmt.Errorf("updating post search entry: %w", err)
+	}
+
+	return nil
+}
+
+// postExternalEmbed returns the link card of a post, if it has one
+func postExternalEmbed(rec *bsky.FeedPost) *bsky.EmbedExternal_External {
+	if rec.Embed == nil {
+		return nil
+	}
+
+	if rec.Embed.EmbedExternal != nil {
+		return rec.Embed.EmbedExternal.External
+	}
+
+	if rec.Embed.EmbedRecordWithMedia != nil &&
+		rec.Embed.EmbedRecordWithMedia.Media != nil &&
+		rec.Embed.EmbedRecordWithMedia.Media.EmbedExternal != nil {
+		return rec.Embed.EmbedRecordWithMedia.Media.EmbedExternal.External
+	}
+
+	return nil
+}
+
+// NormalizeSearchTag returns a hashtag the way it is stored in the search
+// index: lowercase and without the leading #.
+func NormalizeSearchTag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+}
+
+// NormalizeSearchDomain returns a hostname the way it is stored in the search
+// index, so that example.com and www.example.com match.
+func NormalizeSearchDomain(host string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(host, ".")), "www.")
+}
+
+// NormalizeSearchLang reduces a language tag to its primary language, so a
+// search for en finds posts tagged en-US.
+func NormalizeSearchLang(lang string) string {
+	lang, _, _ = strings.Cut(strings.TrimSpace(lang), "-")
+	return strings.ToLower(lang)
+}
+
+// NormalizeSearchURL returns a URL the way it is stored in the search index,
+// with the scheme and host lowercased and without a fragment or trailing
+// slash.
+func NormalizeSearchURL(u string) string {
+	pu, err := url.Parse(strings.TrimSpace(u))
+	if err != nil || pu.Host == "" {
+		return strings.TrimSpace(u)
+	}
+
+	pu.Scheme = strings.ToLower(pu.Scheme)
+	pu.Host = strings.ToLower(pu.Host)
+	pu.Fragment = ""
+	return strings.TrimSuffix(pu.String(), "/")
+}
+
+// ReindexPostSearch builds the search entries of posts indexed before post
+// search existed.
+func ReindexPostSearch(ctx context.Context, pool *pgxpool.Pool) error {
+	var maxID int64
+	if err := pool.QueryRow(ctx, "SELECT COALESCE(MAX(id), 0) FROM posts").Scan(&maxID); err != nil {
+		return err
+	}
+
+	for start := int64(0); start < maxID; start += reindexBatchSize {
+		rows, err := pool.Query(ctx, `SELECT id, author, created, raw FROM posts
+WHERE id > $1 AND id <= $2 AND NOT not_found AND raw IS NOT NULL`, start, start+reindexBatchSize)
+		if err != nil {
+			return fmt.Errorf("loading posts: %w", err)
+		}
+
+		posts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Post, error) {
+			var p Post
+			err := row.Scan(&p.ID, &p.Author, &p.Created, &p.Raw)
+			return p, err
+		})
+		if err != nil {
+			return fmt.Errorf("loading posts: %w", err)
+		}
+
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, p := range posts {
+			var rec bsky.FeedPost
+			if err := rec.UnmarshalCBOR(bytes.NewReader(p.Raw)); err != nil {
+				continue
+			}
+
+			if err := indexPostSearch(ctx, tx, &p, &rec); err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		if start%(reindexBatchSize*100) == 0 {
+			slog.Info("reindexing post search", "at", start, "max_id", maxID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var trendingComputeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "trending_compute_duration",
+	Help:    "Time taken to recompute the trending hashtags, in milliseconds",
+	Buckets: prometheus.ExponentialBuckets(10, 2, 12),
+})
+
+var trendingTagsGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "trending_tags",
+	Help: "Number of hashtags currently trending",
+})
+
+// Trending topics are the hashtags whose use by distinct authors in a recent
+// window is well above what the baseline period before it would predict. A
+// couple of windows are looked at so that both sudden spikes and topics
+// building up over the day show. Only posts we index count, so topics
+// reflect the local network rather than the whole of the firehose.
+
+// TrendingConfig configures the trending topics computation
+type TrendingConfig struct {
+	// MinAuthors is the number of distinct authors that must have used a tag
+	// in a window for it to trend there
+	MinAuthors int
+
+	// Baseline is how far back usage is looked at to decide what is normal
+	// for a tag
+	Baseline time.Duration
+
+	// Interval is how often trending topics are recomputed
+	Interval time.Duration
+}
+
+// trendingWindows are the recent windows compared against the baseline
+var trendingWindows = []time.Duration{time.Hour, time.Hour * 6}
+
+const (
+	maxTrendingTags   = 25
+	maxSuggestedTags  = 25
+	defaultMinAuthors = 5
+)
+
+// TrendingTag is a hashtag with how many distinct authors used it
+type TrendingTag struct {
+	Tag     string
+	Authors int
+	Score   float64
+}
+
+// TrendingTags is the result of a trending computation. Topics are the tags
+// trending right now, Suggested are the tags that are popular over the whole
+// baseline.
+type TrendingTags struct {
+	Topics    []TrendingTag
+	Suggested []TrendingTag
+	Computed  time.Time
+}
+
+// StartTrending computes trending topics and keeps recomputing them in the
+// background.
+func (b *PostgresBackend) StartTrending(ctx context.Context, cfg TrendingConfig) {
+	if cfg.MinAuthors <= 0 {
+		cfg.MinAuthors = defaultMinAuthors
+	}
+	if cfg.Baseline <= trendingWindows[len(trendingWindows)-1] {
+		cfg.Baseline = time.Hour * 24 * 7
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute * 5
+	}
+
+	go func() {
+		tick := time.NewTicker(cfg.Interval)
+		defer tick.Stop()
+
+		for {
+			start := time.Now()
+			tt, err := b.computeTrending(ctx, cfg)
+			if err != nil {
+				slog.Error("failed to compute trending topics", "error", err)
+			} else {
+				b.trending.Store(tt)
+				trendingTagsGauge.Set(float64(len(tt.Topics)))
+			}
+			trendingComputeDuration.Observe(float64(time.Since(start).Milliseconds()))
+
+			select {
+			case <-tick.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// TrendingTags returns the last computed trending topics, or nil if they
+// haven't been computed yet.
+func (b *PostgresBackend) TrendingTags() *TrendingTags {
+	return b.trending.Load()
+}
+
+// tagUsageQuery counts the distinct active authors using each tag in a time
+// range.
+const tagUsageQuery = `
+SELECT t.tag, count(DISTINCT ps.author)
+FROM post_searches ps, unnest(ps.tags) AS t(tag)
+WHERE ps.created > $1 AND ps.created <= $2
+AND NOT EXISTS (SELECT 1 FROM account_statuses a WHERE a.repo = ps.author)
+GROUP BY t.tag
+HAVING count(DISTINCT ps.author) >= $3
+`
+
+func (b *PostgresBackend) tagUsage(ctx context.Context, from, to time.Time, minAuthors int) (map[string]int, error) {
+	rows, err := b.pgx.Query(ctx, tagUsageQuery, from, to, minAuthors)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]int)
+	var tag string
+	var authors int
+	if _, err := pgx.ForEachRow(rows, []any{&tag, &authors}, func() error {
+		out[tag] = authors
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (b *PostgresBackend) computeTrending(ctx context.Context, cfg TrendingConfig) (*TrendingTags, error) {
+	now := time.Now()
+	baseStart := now.Add(-cfg.Baseline)
+
+	scores := make(map[string]TrendingTag)
+	for _, w := range trendingWindows {
+		recent, err := b.tagUsage(ctx, now.Add(-w), now, cfg.MinAuthors)
+		if err != nil {
+			return nil, fmt.Errorf("counting tag usage over %s: %w", w, err)
+		}
+
+		if len(recent) == 0 {
+			continue
+		}
+
+		before, err := b.tagUsage(ctx, baseStart, now.Add(-w), 1)
+		if err != nil {
+			return nil, fmt.Errorf("counting baseline tag usage: %w", err)
+		}
+
+		// the fraction of the baseline period the window covers
+		frac := float64(w) / float64(cfg.Baseline-w)
+
+		for tag, authors := range recent {
+			expected := float64(before[tag]) * frac
+			score := float64(authors) / (expected + 1)
+			if score <= 1 {
+				continue
+			}
+
+			if cur, ok := scores[tag]; !ok || score > cur.Score {
+				scores[tag] = TrendingTag{
+					Tag:     tag,
+					Authors: authors,
+					Score:   score,
+				}
+			}
+		}
+	}
+
+	baseline, err := b.tagUsage(ctx, baseStart, now, cfg.MinAuthors)
+	if err != nil {
+		return nil, fmt.Errorf("counting baseline tag usage: %w", err)
+	}
+
+	tt := &TrendingTags{Computed: now}
+	for _, t := range scores {
+		tt.Topics = append(tt.Topics, t)
+	}
+	sort.Slice(tt.Topics, func(i, j int) bool {
+		if tt.Topics[i].Score != tt.Topics[j].Score {
+			return tt.Topics[i].Score > tt.Topics[j].Score
+		}
+		return tt.Topics[i].Tag < tt.Topics[j].Tag
+	})
+	if len(tt.Topics) > maxTrendingTags {
+		tt.Topics = tt.Topics[:maxTrendingTags]
+	}
+
+	for tag, authors := range baseline {
+		if _, ok := scores[tag]; ok {
+			continue
+		}
+		tt.Suggested = append(tt.Suggested, TrendingTag{
+			Tag:     tag,
+			Authors: authors,
+		})
+	}
+	sort.Slice(tt.Suggested, func(i, j int) bool {
+		if tt.Suggested[i].Authors != tt.Suggested[j].Authors {
+			return tt.Suggested[i].Authors > tt.Suggested[j].Authors
+		}
+		return tt.Suggested[i].Tag < tt.Suggested[j].Tag
+	})
+	if len(tt.Suggested) > maxSuggestedTags {
+		tt.Suggested = tt.Suggested[:maxSuggestedTags]
+	}
+
+	return tt, nil
+}
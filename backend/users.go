@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	. "github.com/whyrusleeping/konbini/models"
+	"gorm.io/gorm/clause"
+)
+
+// ErrUserNotAllowed is returned when registering a DID that this instance
+// doesn't serve.
+var ErrUserNotAllowed = errors.New("account is not served by this instance")
+
+type localUsers struct {
+	byDid  map[string]*LocalUser
+	byRepo map[uint]*LocalUser
+
+	// DIDs allowed to register as local users, "*" allows anyone
+	allowed map[string]bool
+
+	// serializes registration so we only set up each user once
+	regLk sync.Mutex
+	lk    sync.Mutex
+}
+
+// SetAllowedUsers sets the DIDs that are registered as local users the first
+// time they make an authenticated request. The account the instance was
+// started with is always allowed. Passing "*" allows any account.
+func (b *PostgresBackend) SetAllowedUsers(dids []string) {
+	b.users.lk.Lock()
+	defer b.users.lk.Unlock()
+
+	b.users.allowed = make(map[string]bool, len(dids))
+	for _, d := range dids {
+		b.users.allowed[d] = true
+	}
+}
+
+func (b *PostgresBackend) loadLocalUsers(ctx context.Context) error {
+	var users []*LocalUser
+	if err := b.db.WithContext(ctx).Find(&users).Error; err != nil {
+		return err
+	}
+
+	b.users.lk.Lock()
+	defer b.users.lk.Unlock()
+
+	for _, u := range users {
+		b.users.byDid[u.Did] = u
+		b.users.byRepo[u.Repo] = u
+	}
+
+	return nil
+}
+
+func (b *PostgresBackend) localUser(did string) *LocalUser {
+	b.users.lk.Lock()
+	defer b.users.lk.Unlock()
+
+	return b.users.byDid[did]
+}
+
+func (b *PostgresBackend) localUserByRepo(repo uint) *LocalUser {
+	b.users.lk.Lock()
+	defer b.users.lk.Unlock()
+
+	return b.users.byRepo[repo]
+}
+
+// IsLocalUser returns true if the DID is a registered local user.
+func (b *PostgresBackend) IsLocalUser(did string) bool {
+	return b.localUser(did) != nil
+}
+
+// LocalUsers returns all registered local users.
+func (b *PostgresBackend) LocalUsers() []*LocalUser {
+	b.users.lk.Lock()
+	defer b.users.lk.Unlock()
+
+	out := make([]*LocalUser, 0, len(b.users.byDid))
+	for _, u := range b.users.byDid {
+		out = append(out, u)
+	}
+	return out
+}
+
+func (b *PostgresBackend) userAllowed(did string) bool {
+	b.users.lk.Lock()
+	defer b.users.lk.Unlock()
+
+	return did == b.mydid || b.users.allowed["*"] || b.users.allowed[did]
+}
+
+// EnsureLocalUser registers the DID as a local user if it isn't one already.
+// A new user's follows are scraped from their PDS and their follow graph is
+// added to the relevant set in the background, so the request that triggered
+// registration isn't held up by it.
+func (b *PostgresBackend) EnsureLocalUser(ctx context.Context, did string) (*LocalUser, error) {
+	if u := b.localUser(did); u != nil {
+		return u, nil
+	}
+
+	if !b.userAllowed(did) {
+		return nil, ErrUserNotAllowed
+	}
+
+	u, created, err := b.registerLocalUser(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		go b.setupLocalUser(context.Background(), u)
+	}
+
+	return u, nil
+}
+
+// registerLocalUser adds the DID to the local_users table and gives it the
+// self relevance reason. It returns false if the user was already registered.
+func (b *PostgresBackend) registerLocalUser(ctx context.Context, did string) (*LocalUser, bool, error) {
+	b.users.regLk.Lock()
+	defer b.users.regLk.Unlock()
+
+	// someone else may have registered it while we waited
+	if u := b.localUser(did); u != nil {
+		return u, false, nil
+	}
+
+	r, err := b.GetOrCreateRepo(ctx, did)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u := &LocalUser{
+		Did:  did,
+		Repo: r.ID,
+	}
+	if err := b.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(u).Error; err != nil {
+		return nil, false, fmt.Errorf("failed to create local user: %w", err)
+	}
+
+	b.users.lk.Lock()
+	b.users.byDid[did] = u
+	b.users.byRepo[r.ID] = u
+	b.users.lk.Unlock()
+
+	b.rdLk.Lock()
+	b.addRelevantLk(did, RelevanceReason{Reason: RelevanceSelf, User: did})
+	b.rdLk.Unlock()
+	b.flushRelevance(ctx)
+
+	slog.Info("registered local user", "did", did)
+	return u, true, nil
+}
+
+// setupLocalUser brings a newly registered user's follow graph into the
+// relevant set and backfills their own repo.
+func (b *PostgresBackend) setupLocalUser(ctx context.Context, u *LocalUser) {
+	if err := b.ensureFollowsScraped(ctx, u.Did); err != nil {
+		slog.Error("failed to scrape follows for local user", "did", u.Did, "error", err)
+	}
+
+	if err := b.recomputeUserRelevance(ctx, u); err != nil {
+		slog.Error("failed to compute relevance for local user", "did", u.Did, "error", err)
+	}
+
+	if _, err := b.EnqueueBackfill(ctx, u.Did, "local-user"); err != nil {
+		slog.Error("failed to enqueue backfill for local user", "did", u.Did, "error", err)
+	}
+}
@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/bluesky-social/indigo/api/atproto"
+	atrepo "github.com/bluesky-social/indigo/atproto/repo"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var commitVerifyFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "commit_verify_failures",
+	Help: "Number of firehose commits rejected by verification",
+}, []string{"host", "reason"})
+
+// CommitVerifyError is returned by VerifyCommit for commits that should be
+// rejected.
+type CommitVerifyError struct {
+	Reason string
+	Err    error
+}
+
+func (e *CommitVerifyError) Error() string {
+	return fmt.Sprintf("commit verification failed (%s): %s", e.Reason, e.Err)
+}
+
+func (e *CommitVerifyError) Unwrap() error {
+	return e.Err
+}
+
+// VerifyCommit checks a firehose commit following the sync 1.1 "inductive
+// firehose" rules: the commit must be signed by the repo's current signing
+// key, inverting the ops against the included MST blocks must produce the
+// tree referenced by prevData, and that tree must be the one we have stored
+// for the repo.
+func (b *PostgresBackend) VerifyCommit(ctx context.Context, host string, evt *atproto.SyncSubscribeRepos_Commit) error {
+	if err := verifyCommit(ctx, b, evt); err != nil {
+		var verr *CommitVerifyError
+		if errors.As(err, &verr) {
+			commitVerifyFailures.WithLabelValues(host, verr.Reason).Inc()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func verifyCommit(ctx context.Context, b *PostgresBackend, evt *atproto.SyncSubscribeRepos_Commit) error {
+	if evt.TooBig {
+		return &CommitVerifyError{Reason: "toobig", Err: fmt.Errorf("commit has tooBig set")}
+	}
+
+	if evt.PrevData == nil {
+		return &CommitVerifyError{Reason: "prevdata", Err: fmt.Errorf("commit has no prevData")}
+	}
+
+	// VerifyCommitMessage quietly accepts legacy ops that can't be inverted,
+	// which would let an unverified tree through
+	for _, op := range evt.Ops {
+		if (op.Action == "update" || op.Action == "delete") && op.Prev == nil {
+			return &CommitVerifyError{Reason: "legacy_op", Err: fmt.Errorf("%s op for %s has no prev cid", op.Action, op.Path)}
+		}
+	}
+
+	if _, err := atrepo.VerifyCommitMessage(ctx, evt); err != nil {
+		return &CommitVerifyError{Reason: "mst", Err: err}
+	}
+
+	if err := atrepo.VerifyCommitSignature(ctx, b.dir, evt); err != nil {
+		// the signing key may have been rotated since we cached the DID
+		// document, refresh it and try once more
+		did, perr := syntax.ParseDID(evt.Repo)
+		if perr != nil {
+			return &CommitVerifyError{Reason: "did", Err: perr}
+		}
+
+		if !b.allowSigRefresh(evt.Repo) {
+			return &CommitVerifyError{Reason: "signature", Err: err}
+		}
+
+		if err := b.dir.Purge(ctx, did.AtIdentifier()); err != nil {
+			slog.Warn("failed to purge identity for signature retry", "did", did, "error", err)
+		}
+
+		if err := atrepo.VerifyCommitSignature(ctx, b.dir, evt); err != nil {
+			return &CommitVerifyError{Reason: "signature", Err: err}
+		}
+	}
+
+	return b.verifyCommitChain(ctx, evt)
+}
+
+// minimum time between forced DID document refreshes for the same account,
+// so a PDS sending badly signed commits can't make us resolve on every event
+const sigRefreshInterval = time.Minute
+
+func (b *PostgresBackend) allowSigRefresh(did string) bool {
+	b.sigRefreshLk.Lock()
+	defer b.sigRefreshLk.Unlock()
+
+	if last, ok := b.sigRefreshes.Get(did); ok && time.Since(last) < sigRefreshInterval {
+		return false
+	}
+
+	b.sigRefreshes.Add(did, time.Now())
+	return true
+}
+
+// verifyCommitChain checks that a commit continues from the last commit we
+// processed for the repo: its since must be our stored rev and its prevData
+// our stored MST root. Commits that don't are rejected and the repo is
+// resynced, since we can no longer trust our copy of it.
+func (b *PostgresBackend) verifyCommitChain(ctx context.Context, evt *atproto.SyncSubscribeRepos_Commit) error {
+	rev, data, err := b.repoSyncState(ctx, evt.Repo)
+	if err != nil {
+		return err
+	}
+
+	// nothing to compare against, or a replay of a commit we already have
+	if rev == "" || evt.Rev <= rev {
+		return nil
+	}
+
+	if evt.Since == nil || *evt.Since != rev {
+		b.EnqueueResync(evt.Repo, "chain")
+		return &CommitVerifyError{Reason: "chain", Err: fmt.Errorf("commit since %v does not match stored rev %s", evt.Since, rev)}
+	}
+
+	// rows written before we tracked the MST root only have a rev
+	if data != "" && cid.Cid(*evt.PrevData).String() != data {
+		b.EnqueueResync(evt.Repo, "chain")
+		return &CommitVerifyError{Reason: "chain", Err: fmt.Errorf("commit prevData %s does not match stored data %s", cid.Cid(*evt.PrevData), data)}
+	}
+
+	return nil
+}
+
+// VerifyEventHost checks that a non-commit event (#account, #identity or
+// #sync) about did came from the PDS that hosts it. Unlike commits these
+// events aren't signed, so on a verified backend the only thing vouching
+// for them is the host they arrived from.
+func (b *PostgresBackend) VerifyEventHost(ctx context.Context, host, did string) error {
+	d, err := syntax.ParseDID(did)
+	if err != nil {
+		commitVerifyFailures.WithLabelValues(host, "did").Inc()
+		return err
+	}
+
+	ident, err := b.dir.LookupDID(ctx, d)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", did, err)
+	}
+
+	pds := ident.PDSEndpoint()
+	if u, err := url.Parse(pds); err != nil || u.Host != host {
+		commitVerifyFailures.WithLabelValues(host, "host").Inc()
+		return fmt.Errorf("event for %s came from %s, but its PDS is %q", did, host, pds)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/cmd/relay/stream"
+	"github.com/bluesky-social/jetstream/pkg/models"
+	"gorm.io/gorm"
+)
+
+const cursorFlushInterval = time.Second * 5
+
+// cursorTracker keeps track of the events from a single sync backend that are
+// still being processed by the parallel scheduler. The cursor it reports is
+// the highest position below which every event has completed, so resuming
+// from it never skips an event that was in flight.
+type cursorTracker struct {
+	host string
+
+	lk       sync.Mutex
+	inflight map[int64]int
+	maxSeen  int64
+	stored   int64
+}
+
+func newCursorTracker(host string, start int64) *cursorTracker {
+	return &cursorTracker{
+		host:     host,
+		inflight: make(map[int64]int),
+		maxSeen:  start,
+		stored:   start,
+	}
+}
+
+// Begin marks an event as handed off to the scheduler. Events must be begun
+// in stream order. Jetstream events may share a timestamp, so positions are
+// reference counted.
+func (ct *cursorTracker) Begin(seq int64) {
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+
+	ct.inflight[seq]++
+	if seq > ct.maxSeen {
+		ct.maxSeen = seq
+	}
+
+	firehoseCursorGauge.WithLabelValues(ct.host, "ingest").Set(float64(seq))
+}
+
+// Done marks an event as fully processed.
+func (ct *cursorTracker) Done(seq int64) {
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+
+	ct.inflight[seq]--
+	if ct.inflight[seq] <= 0 {
+		delete(ct.inflight, seq)
+	}
+}
+
+// Cursor returns the low-water mark: every event at or below it has been
+// processed.
+func (ct *cursorTracker) Cursor() int64 {
+	ct.lk.Lock()
+	defer ct.lk.Unlock()
+
+	return ct.cursor()
+}
+
+func (ct *cursorTracker) cursor() int64 {
+	if len(ct.inflight) == 0 {
+		return ct.maxSeen
+	}
+
+	low := ct.maxSeen
+	for seq := range ct.inflight {
+		if seq < low {
+			low = seq
+		}
+	}
+
+	return low - 1
+}
+
+func (ct *cursorTracker) flush(db *gorm.DB) error {
+	ct.lk.Lock()
+	curs := ct.cursor()
+	if curs <= ct.stored {
+		ct.lk.Unlock()
+		return nil
+	}
+	ct.lk.Unlock()
+
+	if err := storeLastSeq(db, ct.host, curs); err != nil {
+		return err
+	}
+
+	ct.lk.Lock()
+	if curs > ct.stored {
+		ct.stored = curs
+	}
+	ct.lk.Unlock()
+
+	firehoseCursorGauge.WithLabelValues(ct.host, "complete").Set(float64(curs))
+	return nil
+}
+
+// run periodically persists the cursor until the context is cancelled, then
+// does one final flush.
+func (ct *cursorTracker) run(ctx context.Context, db *gorm.DB) {
+	tick := time.NewTicker(cursorFlushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if err := ct.flush(db); err != nil {
+				slog.Error("failed to store cursor", "host", ct.host, "error", err)
+			}
+		case <-ctx.Done():
+			if err := ct.flush(db); err != nil {
+				slog.Error("failed to store cursor", "host", ct.host, "error", err)
+			}
+			return
+		}
+	}
+}
+
+// trackedScheduler wraps a firehose scheduler so that every event is
+// registered with the cursor tracker before it is queued.
+type trackedScheduler struct {
+	stream.Scheduler
+	ct *cursorTracker
+}
+
+func (ts *trackedScheduler) AddWork(ctx context.Context, repo string, xev *stream.XRPCStreamEvent) error {
+	seq, ok := streamEventSeq(xev)
+	if ok {
+		ts.ct.Begin(seq)
+	}
+
+	return ts.Scheduler.AddWork(ctx, repo, xev)
+}
+
+func streamEventSeq(xev *stream.XRPCStreamEvent) (int64, bool) {
+	switch {
+	case xev.RepoCommit != nil:
+		return xev.RepoCommit.Seq, true
+	case xev.RepoSync != nil:
+		return xev.RepoSync.Seq, true
+	case xev.RepoIdentity != nil:
+		return xev.RepoIdentity.Seq, true
+	case xev.RepoAccount != nil:
+		return xev.RepoAccount.Seq, true
+	default:
+		return 0, false
+	}
+}
+
+type jetstreamScheduler interface {
+	AddWork(ctx context.Context, repo string, evt *models.Event) error
+	Shutdown()
+}
+
+// trackedJetstreamScheduler is the jetstream equivalent of trackedScheduler,
+// using the event time as the cursor.
+type trackedJetstreamScheduler struct {
+	jetstreamScheduler
+	ct *cursorTracker
+}
+
+func (ts *trackedJetstreamScheduler) AddWork(ctx context.Context, repo string, evt *models.Event) error {
+	ts.ct.Begin(evt.TimeUS)
+	return ts.jetstreamScheduler.AddWork(ctx, repo, evt)
+}
+
+// startCursorTracker registers a tracker for the given backend and starts
+// persisting its cursor. The returned function stops it and waits for the
+// final flush, so the next connection loads an up to date cursor. It must
+// only be called once the scheduler feeding the tracker has shut down.
+func (s *Server) startCursorTracker(host string, start int64) (*cursorTracker, func()) {
+	ct := newCursorTracker(host, start)
+	s.registerCursor(ct)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ct.run(ctx, s.db)
+	}()
+
+	return ct, func() {
+		cancel()
+		<-done
+	}
+}
+
+func (s *Server) registerCursor(ct *cursorTracker) {
+	s.cursorsLk.Lock()
+	defer s.cursorsLk.Unlock()
+	s.cursors[ct.host] = ct
+}
+
+// backendCursors returns the current low-water mark for each sync backend.
+func (s *Server) backendCursors() map[string]int64 {
+	s.cursorsLk.Lock()
+	defer s.cursorsLk.Unlock()
+
+	out := make(map[string]int64, len(s.cursors))
+	for host, ct := range s.cursors {
+		out[host] = ct.Cursor()
+	}
+	return out
+}
@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	xrpclib "github.com/bluesky-social/indigo/xrpc"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
@@ -27,7 +29,16 @@ func (s *Server) runApiServer() error {
 	e.Use(middleware.CORS())
 	e.GET("/debug", s.handleGetDebugInfo)
 	e.GET("/reldids", s.handleGetRelevantDids)
+	e.GET("/reldids/entries", s.handleListRelevantDids)
+	e.POST("/reldids/:did", s.handleAddRelevantDid)
+	e.DELETE("/reldids/:did", s.handleRemoveRelevantDid)
+	e.POST("/reldids/:did/pin", s.handlePinRelevantDid)
+	e.POST("/reldids/:did/unpin", s.handleUnpinRelevantDid)
+	e.GET("/users", s.handleListLocalUsers)
 	e.GET("/rescan/:did", s.handleRescanDid)
+	e.GET("/backfill/jobs", s.handleListBackfillJobs)
+	e.POST("/backfill/jobs/:id/cancel", s.handleCancelBackfillJob)
+	e.POST("/backfill/enqueue/:did", s.handleRescanDid)
 
 	views := e.Group("/api")
 	views.GET("/me", s.handleGetMe)
@@ -36,28 +47,157 @@ func (s *Server) runApiServer() error {
 	views.GET("/profile/:account", s.handleGetProfileView)
 	views.GET("/profile/:account/posts", s.handleGetProfilePosts)
 	views.GET("/followingfeed", s.handleGetFollowingFeed)
+	views.GET("/tag/:tag", s.handleGetTagFeed)
 	views.GET("/thread/:postid", s.handleGetThread)
 	views.GET("/post/:postid/likes", s.handleGetPostLikes)
 	views.GET("/post/:postid/reposts", s.handleGetPostReposts)
 	views.GET("/post/:postid/replies", s.handleGetPostReplies)
 	views.POST("/createRecord", s.handleCreateRecord)
 
+	e.GET("/oauth/client-metadata.json", s.handleOAuthClientMetadata)
+	e.GET("/oauth/login", s.handleOAuthLogin)
+	e.GET("/oauth/callback", s.handleOAuthCallback)
+
 	return e.Start(":4444")
 }
 
 func (s *Server) handleGetDebugInfo(e echo.Context) error {
-	s.seqLk.Lock()
-	seq := s.lastSeq
-	s.seqLk.Unlock()
-
 	return e.JSON(200, map[string]any{
-		"seq": seq,
+		"cursors": s.backendCursors(),
 	})
 }
 
 func (s *Server) handleGetRelevantDids(e echo.Context) error {
+	reasons := s.backend.GetRelevantDidReasons()
+
+	dids := make([]string, 0, len(reasons))
+	counts := make(map[string]int)
+	for did, rs := range reasons {
+		dids = append(dids, did)
+		for _, r := range rs {
+			counts[r.Reason]++
+		}
+	}
+
+	return e.JSON(200, map[string]any{
+		"dids":    dids,
+		"reasons": reasons,
+		"counts":  counts,
+	})
+}
+
+func (s *Server) handleListLocalUsers(e echo.Context) error {
+	users := s.backend.LocalUsers()
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	return e.JSON(200, map[string]any{
+		"users": users,
+	})
+}
+
+func (s *Server) handleListRelevantDids(e echo.Context) error {
+	limit := 100
+	if lstr := e.QueryParam("limit"); lstr != "" {
+		l, err := strconv.Atoi(lstr)
+		if err != nil {
+			return e.JSON(400, map[string]any{
+				"error": "invalid limit",
+			})
+		}
+		limit = l
+	}
+
+	var offset int
+	if ostr := e.QueryParam("offset"); ostr != "" {
+		o, err := strconv.Atoi(ostr)
+		if err != nil {
+			return e.JSON(400, map[string]any{
+				"error": "invalid offset",
+			})
+		}
+		offset = o
+	}
+
+	entries, err := s.backend.ListRelevantDids(e.Request().Context(), e.QueryParam("reason"), e.QueryParam("user"), limit, offset)
+	if err != nil {
+		return err
+	}
+
 	return e.JSON(200, map[string]any{
-		"dids": s.backend.GetRelevantDids(),
+		"entries": entries,
+	})
+}
+
+// handleAddRelevantDid adds an account to the relevant set by hand and
+// backfills it. Pass ?pin=true to pin it as well.
+func (s *Server) handleAddRelevantDid(e echo.Context) error {
+	ctx := e.Request().Context()
+	did, err := s.resolveAccountIdent(ctx, e.Param("did"))
+	if err != nil {
+		return err
+	}
+
+	if e.QueryParam("pin") == "true" {
+		if err := s.backend.SetRelevantDidPinned(ctx, did, true); err != nil {
+			return err
+		}
+	}
+
+	job, err := s.rescanRepo(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"did":     did,
+		"reasons": s.backend.RelevanceReasons(did),
+		"job":     job,
+	})
+}
+
+func (s *Server) handleRemoveRelevantDid(e echo.Context) error {
+	ctx := e.Request().Context()
+	did, err := s.resolveAccountIdent(ctx, e.Param("did"))
+	if err != nil {
+		return err
+	}
+
+	remaining, err := s.backend.RemoveRelevantDid(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"did":     did,
+		"reasons": remaining,
+	})
+}
+
+func (s *Server) handlePinRelevantDid(e echo.Context) error {
+	return s.setRelevantDidPinned(e, true)
+}
+
+func (s *Server) handleUnpinRelevantDid(e echo.Context) error {
+	return s.setRelevantDidPinned(e, false)
+}
+
+func (s *Server) setRelevantDidPinned(e echo.Context, pinned bool) error {
+	ctx := e.Request().Context()
+	did, err := s.resolveAccountIdent(ctx, e.Param("did"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.backend.SetRelevantDidPinned(ctx, did, pinned); err != nil {
+		return err
+	}
+
+	return e.JSON(200, map[string]any{
+		"did":     did,
+		"pinned":  pinned,
+		"reasons": s.backend.RelevanceReasons(did),
 	})
 }
 
@@ -70,10 +210,50 @@ func (s *Server) handleRescanDid(e echo.Context) error {
 		return err
 	}
 
-	if err := s.rescanRepo(ctx, did); err != nil {
+	job, err := s.rescanRepo(ctx, did)
+	if err != nil {
+		return err
+	}
+
+	return e.JSON(200, job)
+}
+
+func (s *Server) handleListBackfillJobs(e echo.Context) error {
+	limit := 100
+	if lstr := e.QueryParam("limit"); lstr != "" {
+		l, err := strconv.Atoi(lstr)
+		if err != nil {
+			return e.JSON(400, map[string]any{
+				"error": "invalid limit",
+			})
+		}
+		limit = l
+	}
+
+	jobs, err := s.backend.ListBackfillJobs(e.Request().Context(), e.QueryParam("state"), limit)
+	if err != nil {
 		return err
 	}
 
+	return e.JSON(200, map[string]any{
+		"jobs": jobs,
+	})
+}
+
+func (s *Server) handleCancelBackfillJob(e echo.Context) error {
+	id, err := strconv.ParseUint(e.Param("id"), 10, 64)
+	if err != nil {
+		return e.JSON(400, map[string]any{
+			"error": "invalid job id",
+		})
+	}
+
+	if err := s.backend.CancelBackfill(e.Request().Context(), uint(id)); err != nil {
+		return e.JSON(404, map[string]any{
+			"error": err.Error(),
+		})
+	}
+
 	return e.JSON(200, map[string]any{"status": "ok"})
 }
 
@@ -211,6 +391,7 @@ type postCounts struct {
 	Likes   int `json:"likes"`
 	Reposts int `json:"reposts"`
 	Replies int `json:"replies"`
+	Quotes  int `json:"quotes"`
 }
 
 type embedRecordView struct {
@@ -295,6 +476,53 @@ func (s *Server) handleGetFollowingFeed(e echo.Context) error {
 	})
 }
 
+// handleGetTagFeed lists the posts we have indexed with a hashtag, newest
+// first
+func (s *Server) handleGetTagFeed(e echo.Context) error {
+	ctx := e.Request().Context()
+
+	tag := backend.NormalizeSearchTag(e.Param("tag"))
+	if tag == "" {
+		return e.JSON(400, map[string]any{
+			"error": "tag is required",
+		})
+	}
+
+	// Get cursor from query parameter (timestamp in RFC3339 format)
+	cursor := e.QueryParam("cursor")
+	limit := 20
+
+	tcursor := time.Now()
+	if cursor != "" {
+		t, err := time.Parse(time.RFC3339, cursor)
+		if err != nil {
+			return fmt.Errorf("invalid cursor: %w", err)
+		}
+		tcursor = t
+	}
+
+	var dbposts []models.Post
+	if err := s.db.Raw(`SELECT p.* FROM posts p JOIN post_searches ps ON ps.post = p.id
+WHERE ps.tags @> ARRAY[?]::text[] AND ps.created < ?
+AND NOT EXISTS (SELECT 1 FROM account_statuses a WHERE a.repo = ps.author)
+ORDER BY ps.created DESC LIMIT ?`, tag, tcursor, limit).Scan(&dbposts).Error; err != nil {
+		return err
+	}
+
+	posts := s.hydratePosts(ctx, dbposts)
+
+	// Generate next cursor from the last post's timestamp
+	var nextCursor string
+	if len(dbposts) > 0 {
+		nextCursor = dbposts[len(dbposts)-1].Created.Format(time.RFC3339)
+	}
+
+	return e.JSON(200, map[string]any{
+		"posts":  posts,
+		"cursor": nextCursor,
+	})
+}
+
 func (s *Server) getAuthorInfo(ctx context.Context, r *models.Repo) (*authorInfo, error) {
 	var profile models.Profile
 	if err := s.db.Find(&profile, "repo = ?", r.ID).Error; err != nil {
@@ -328,32 +556,9 @@ func (s *Server) getAuthorInfo(ctx context.Context, r *models.Repo) (*authorInfo
 
 func (s *Server) getPostCounts(ctx context.Context, pid uint) (*postCounts, error) {
 	var pc postCounts
-	var wg sync.WaitGroup
-
-	wg.Add(3)
-
-	go func() {
-		defer wg.Done()
-		if err := s.db.Raw("SELECT count(*) FROM likes WHERE subject = ?", pid).Scan(&pc.Likes).Error; err != nil {
-			slog.Error("failed to get likes count", "post", pid, "error", err)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		if err := s.db.Raw("SELECT count(*) FROM reposts WHERE subject = ?", pid).Scan(&pc.Reposts).Error; err != nil {
-			slog.Error("failed to get reposts count", "post", pid, "error", err)
-		}
-	}()
-
-	go func() {
-		defer wg.Done()
-		if err := s.db.Raw("SELECT count(*) FROM posts WHERE reply_to = ?", pid).Scan(&pc.Replies).Error; err != nil {
-			slog.Error("failed to get replies count", "post", pid, "error", err)
-		}
-	}()
-
-	wg.Wait()
+	if err := s.db.Raw("SELECT likes, reposts, replies, quotes FROM post_counts WHERE post = ?", pid).Scan(&pc).Error; err != nil {
+		return nil, err
+	}
 
 	return &pc, nil
 }
@@ -378,6 +583,14 @@ func (s *Server) hydratePosts(ctx context.Context, dbposts []models.Post) []post
 			}
 
 			uri := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", r.Did, p.Rkey)
+			if !s.backend.AccountIsActive(r.Did) {
+				posts[ix] = postResponse{
+					Uri:     uri,
+					Missing: true,
+				}
+				return
+			}
+
 			if len(p.Raw) == 0 || p.NotFound {
 				s.backend.TrackMissingRecord(uri, false)
 				posts[ix] = postResponse{
@@ -609,7 +822,7 @@ func (s *Server) handleGetThread(e echo.Context) error {
 		}
 
 		uri := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", r.Did, p.Rkey)
-		if len(p.Raw) == 0 || p.NotFound {
+		if len(p.Raw) == 0 || p.NotFound || !s.backend.AccountIsActive(r.Did) {
 			posts = append(posts, postResponse{
 				Uri:        uri,
 				Missing:    true,
@@ -889,7 +1102,7 @@ func (s *Server) handleCreateRecord(e echo.Context) error {
 	}
 
 	var resp createRecordResponse
-	if err := s.client.Do(ctx, xrpclib.Procedure, "application/json", "com.atproto.repo.createRecord", nil, input, &resp); err != nil {
+	if err := s.session.Post(ctx, syntax.NSID("com.atproto.repo.createRecord"), input, &resp); err != nil {
 		slog.Error("failed to create record", "error", err)
 		return e.JSON(500, map[string]any{
 			"error":   "failed to create record",
@@ -900,6 +1113,71 @@ func (s *Server) handleCreateRecord(e echo.Context) error {
 	return e.JSON(200, resp)
 }
 
+func (s *Server) handleOAuthClientMetadata(e echo.Context) error {
+	if s.session.oauth == nil {
+		return e.JSON(404, map[string]any{
+			"error": "oauth is not configured",
+		})
+	}
+
+	return e.JSON(200, s.session.oauth.Config.ClientMetadata())
+}
+
+// handleOAuthLogin starts an OAuth login for the account konbini runs as
+func (s *Server) handleOAuthLogin(e echo.Context) error {
+	if s.session.oauth == nil {
+		return e.JSON(404, map[string]any{
+			"error": "oauth is not configured",
+		})
+	}
+
+	redirect, err := s.session.oauth.StartAuthFlow(e.Request().Context(), s.mydid)
+	if err != nil {
+		slog.Error("failed to start oauth login", "error", err)
+		return e.JSON(500, map[string]any{
+			"error": "failed to start login",
+		})
+	}
+
+	return e.Redirect(http.StatusFound, redirect)
+}
+
+func (s *Server) handleOAuthCallback(e echo.Context) error {
+	if s.session.oauth == nil {
+		return e.JSON(404, map[string]any{
+			"error": "oauth is not configured",
+		})
+	}
+
+	ctx := e.Request().Context()
+
+	sess, err := s.session.oauth.ProcessCallback(ctx, e.QueryParams())
+	if err != nil {
+		slog.Error("oauth callback failed", "error", err)
+		return e.JSON(400, map[string]any{
+			"error": "login failed",
+		})
+	}
+
+	if sess.AccountDID.String() != s.mydid {
+		if err := s.session.oauth.Logout(ctx, sess.AccountDID, sess.SessionID); err != nil {
+			slog.Warn("failed to log out of foreign oauth session", "did", sess.AccountDID, "error", err)
+		}
+		return e.JSON(403, map[string]any{
+			"error": "only the account konbini runs as can log in",
+		})
+	}
+
+	if err := s.session.useOAuthSession(ctx, sess.SessionID); err != nil {
+		slog.Error("failed to use new oauth session", "error", err)
+		return e.JSON(500, map[string]any{
+			"error": "failed to use session",
+		})
+	}
+
+	return e.String(200, "logged in, konbini can now write to your repo")
+}
+
 type notificationResponse struct {
 	ID         uint        `json:"id"`
 	Kind       string      `json:"kind"`
@@ -966,8 +1244,8 @@ func (s *Server) handleGetNotifications(e echo.Context) error {
 			CreatedAt: notif.CreatedAt.Format(time.RFC3339),
 		}
 
-		// Try to get source post preview for reply/mention notifications
-		if notif.Kind == backend.NotifKindReply || notif.Kind == backend.NotifKindMention {
+		// Try to get source post preview for reply/mention/quote notifications
+		if notif.Kind == backend.NotifKindReply || notif.Kind == backend.NotifKindMention || notif.Kind == backend.NotifKindQuote {
 			// Parse URI to get post
 			p, err := s.backend.GetPostByUri(ctx, notif.Source, "*")
 			if err == nil && p.Raw != nil && len(p.Raw) > 0 {
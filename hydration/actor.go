@@ -25,6 +25,15 @@ func (h *Hydrator) HydrateActor(ctx context.Context, did string) (*ActorInfo, er
 	ctx, span := tracer.Start(ctx, "hydrateActor")
 	defer span.End()
 
+	if !h.accountIsActive(did) {
+		return nil, ErrAccountInactive
+	}
+
+	if cached, ok := h.cache.getActor(did); ok {
+		return &cached, nil
+	}
+	gen := h.cache.gen(did)
+
 	// Look up handle
 	resp, err := h.dir.LookupDID(ctx, syntax.DID(did))
 	if err != nil {
@@ -51,6 +60,7 @@ func (h *Hydrator) HydrateActor(ctx context.Context, did string) (*ActorInfo, er
 			if err := profile.UnmarshalCBOR(bytes.NewReader(dbProfile.Raw)); err == nil {
 				info.Profile = &profile
 			}
+			h.cache.addActor(did, *info, gen)
 		} else {
 			h.addMissingActor(did)
 		}
@@ -79,25 +89,9 @@ func (h *Hydrator) HydrateActorDetailed(ctx context.Context, did string, viewer
 
 	var wg sync.WaitGroup
 	wg.Go(func() {
-		c, err := h.getFollowCountForUser(ctx, did)
-		if err != nil {
-			slog.Error("failed to get follow count", "did", did, "error", err)
-		}
-		actd.FollowCount = c
-	})
-	wg.Go(func() {
-		c, err := h.getFollowerCountForUser(ctx, did)
-		if err != nil {
-			slog.Error("failed to get follower count", "did", did, "error", err)
+		if err := h.getActorCounts(ctx, did, &actd); err != nil {
+			slog.Error("failed to get actor counts", "did", did, "error", err)
 		}
-		actd.FollowerCount = c
-	})
-	wg.Go(func() {
-		c, err := h.getPostCountForUser(ctx, did)
-		if err != nil {
-			slog.Error("failed to get post count", "did", did, "error", err)
-		}
-		actd.PostCount = c
 	})
 
 	if viewer != "" {
@@ -205,45 +199,27 @@ func (h *Hydrator) getFollowPair(ctx context.Context, a, b string) (*models.Foll
 	return &fol, nil
 }
 
-func (h *Hydrator) getFollowCountForUser(ctx context.Context, did string) (int64, error) {
-	var count int64
-	if err := h.db.Raw("SELECT count(*) FROM follows WHERE author = (SELECT id FROM repos WHERE did = ?)", did).Scan(&count).Error; err != nil {
-		return 0, err
+// getActorCounts fills in the follow, follower and post counts of an actor
+// from the counters the backend maintains.
+func (h *Hydrator) getActorCounts(ctx context.Context, did string, actd *ActorInfoDetailed) error {
+	var counts struct {
+		Follows   int64
+		Followers int64
+		Posts     int64
 	}
-
-	return count, nil
-}
-
-func (h *Hydrator) getFollowerCountForUser(ctx context.Context, did string) (int64, error) {
-	var count int64
-	if err := h.db.Raw("SELECT count(*) FROM follows WHERE subject = (SELECT id FROM repos WHERE did = ?)", did).Scan(&count).Error; err != nil {
-		return 0, err
+	if err := h.db.Raw("SELECT follows, followers, posts FROM actor_counts WHERE repo = (SELECT id FROM repos WHERE did = ?)", did).Scan(&counts).Error; err != nil {
+		return err
 	}
 
-	return count, nil
+	actd.FollowCount = counts.Follows
+	actd.FollowerCount = counts.Followers
+	actd.PostCount = counts.Posts
+	return nil
 }
 
-func (h *Hydrator) getPostCountForUser(ctx context.Context, did string) (int64, error) {
-	var count int64
-	if err := h.db.Raw("SELECT count(*) FROM posts WHERE author = (SELECT id FROM repos WHERE did = ?)", did).Scan(&count).Error; err != nil {
-		return 0, err
-	}
-
-	return count, nil
-}
-
-// HydrateActors hydrates multiple actors
+// HydrateActors hydrates multiple actors, skipping ones that fail to hydrate
 func (h *Hydrator) HydrateActors(ctx context.Context, dids []string) (map[string]*ActorInfo, error) {
-	result := make(map[string]*ActorInfo, len(dids))
-	for _, did := range dids {
-		info, err := h.HydrateActor(ctx, did)
-		if err != nil {
-			// Skip actors that fail to hydrate rather than failing the whole batch
-			continue
-		}
-		result[did] = info
-	}
-	return result, nil
+	return h.loadActors(ctx, dids)
 }
 
 // ResolveDID resolves a handle or DID to a DID
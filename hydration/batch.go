@@ -0,0 +1,443 @@
+package hydration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/whyrusleeping/market/models"
+)
+
+// Batch holds hydrated posts keyed by URI and actors keyed by DID. Posts and
+// actors that couldn't be hydrated, including ones from inactive accounts,
+// are missing from the maps.
+type Batch struct {
+	Posts  map[string]*PostInfo
+	Actors map[string]*ActorInfo
+}
+
+// HydrateBatch hydrates a page worth of posts and actors at once. Posts,
+// their counts, the viewer's likes, quoted posts and profiles are each loaded
+// with a single query however many posts there are. The authors of the posts
+// and of the posts they quote are added to Actors alongside actorDIDs.
+// Posts we only have a stub for are fetched from their PDS first.
+func (h *Hydrator) HydrateBatch(ctx context.Context, postURIs []string, actorDIDs []string, viewerDID string) (*Batch, error) {
+	ctx, span := tracer.Start(ctx, "hydrateBatch")
+	defer span.End()
+
+	posts, err := h.loadPosts(ctx, postURIs, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// quoted posts are rendered inside embeds, without embeds of their own
+	var quotedURIs []string
+	for _, p := range posts {
+		quotedURIs = append(quotedURIs, embeddedPostURIs(p.Post.Embed)...)
+	}
+
+	autoFetch, _ := ctx.Value("auto-fetch").(bool)
+	quoted, err := h.loadPosts(ctx, quotedURIs, autoFetch)
+	if err != nil {
+		return nil, err
+	}
+
+	dids := append([]string{}, actorDIDs...)
+	for _, p := range posts {
+		dids = append(dids, p.Author)
+	}
+	for _, p := range quoted {
+		dids = append(dids, p.Author)
+	}
+
+	var actors map[string]*ActorInfo
+	var actorsErr error
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		actors, actorsErr = h.loadActors(ctx, dids)
+	})
+
+	if err := h.loadPostCounts(ctx, posts, quoted); err != nil {
+		return nil, err
+	}
+
+	if viewerDID != "" {
+		if err := h.loadViewerLikes(ctx, posts, viewerDID); err != nil {
+			return nil, err
+		}
+	}
+
+	wg.Wait()
+	if actorsErr != nil {
+		return nil, actorsErr
+	}
+
+	for _, p := range posts {
+		if p.Post.Embed == nil {
+			continue
+		}
+
+		p.EmbedInfo = formatEmbedWith(p.Post.Embed, p.Author, func(uri string) *bsky.EmbedRecord_View_Record {
+			qp := quoted[uri]
+			if qp == nil {
+				return embeddedRecordView(uri, nil, nil)
+			}
+			return embeddedRecordView(uri, qp, actors[qp.Author])
+		})
+	}
+
+	return &Batch{
+		Posts:  posts,
+		Actors: actors,
+	}, nil
+}
+
+type batchPostRow struct {
+	models.Post
+	Did     string
+	Deleted bool
+}
+
+// loadPosts loads and decodes the given posts, from the cache where
+// possible. If fetch is set, posts we don't have the record for are fetched
+// before giving up on them.
+func (h *Hydrator) loadPosts(ctx context.Context, uris []string, fetch bool) (map[string]*PostInfo, error) {
+	ctx, span := tracer.Start(ctx, "loadPosts")
+	defer span.End()
+
+	out := make(map[string]*PostInfo, len(uris))
+
+	var keys [][]any
+	gens := make(map[string]uint64, len(uris))
+	seen := make(map[string]bool, len(uris))
+	for _, uri := range uris {
+		if seen[uri] {
+			continue
+		}
+		seen[uri] = true
+
+		puri, err := syntax.ParseATURI(uri)
+		if err != nil {
+			slog.Warn("skipping invalid post uri", "uri", uri, "error", err)
+			continue
+		}
+
+		did := puri.Authority().String()
+		if !h.accountIsActive(did) {
+			continue
+		}
+
+		rkey := puri.RecordKey().String()
+		key := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", did, rkey)
+		if p, ok := h.cache.getPost(key); ok {
+			out[key] = &p
+			continue
+		}
+
+		gens[key] = h.cache.gen(key)
+		keys = append(keys, []any{did, rkey})
+	}
+
+	rows, err := h.queryPosts(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if fetch {
+		var missing [][]any
+		var wg sync.WaitGroup
+		for _, k := range keys {
+			uri := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", k[0], k[1])
+			row, ok := rows[uri]
+			if ok && (row.Deleted || (!row.NotFound && len(row.Raw) > 0)) {
+				continue
+			}
+
+			missing = append(missing, k)
+			wg.Go(func() {
+				h.AddMissingRecord(uri, true)
+			})
+		}
+		wg.Wait()
+
+		// fetching them bumped their generation
+		for _, k := range missing {
+			uri := fmt.Sprintf("at://%s/app.bsky.feed.post/%s", k[0], k[1])
+			gens[uri] = h.cache.gen(uri)
+		}
+
+		if len(missing) > 0 {
+			fetched, err := h.queryPosts(ctx, missing)
+			if err != nil {
+				return nil, err
+			}
+			for uri, row := range fetched {
+				rows[uri] = row
+			}
+		}
+	}
+
+	for uri, row := range rows {
+		if row.NotFound || len(row.Raw) == 0 {
+			continue
+		}
+
+		var fp bsky.FeedPost
+		if err := fp.UnmarshalCBOR(bytes.NewReader(row.Raw)); err != nil {
+			slog.Warn("failed to unmarshal post", "uri", uri, "error", err)
+			continue
+		}
+
+		info := &PostInfo{
+			ID:         row.ID,
+			URI:        uri,
+			Cid:        row.Cid,
+			Post:       &fp,
+			Author:     row.Did,
+			ReplyTo:    row.ReplyTo,
+			ReplyToUsr: row.ReplyToUsr,
+			InThread:   row.InThread,
+		}
+		if info.Cid == "" {
+			slog.Error("MISSING CID", "uri", uri)
+			info.Cid = fakeCid
+		}
+
+		h.cache.addPost(uri, *info, gens[uri])
+		out[uri] = info
+	}
+
+	return out, nil
+}
+
+func (h *Hydrator) queryPosts(ctx context.Context, keys [][]any) (map[string]*batchPostRow, error) {
+	out := make(map[string]*batchPostRow, len(keys))
+	if len(keys) == 0 {
+		return out, nil
+	}
+
+	var rows []*batchPostRow
+	if err := h.db.WithContext(ctx).Raw(`
+		SELECT p.*, r.did
+		FROM posts p
+		JOIN repos r ON r.id = p.author
+		WHERE (r.did, p.rkey) IN ?
+	`, keys).Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to query posts: %w", err)
+	}
+
+	for _, row := range rows {
+		out[fmt.Sprintf("at://%s/app.bsky.feed.post/%s", row.Did, row.Rkey)] = row
+	}
+
+	return out, nil
+}
+
+// loadPostCounts fills in the engagement counts of all the given posts.
+func (h *Hydrator) loadPostCounts(ctx context.Context, sets ...map[string]*PostInfo) error {
+	ctx, span := tracer.Start(ctx, "loadPostCounts")
+	defer span.End()
+
+	byID := make(map[uint][]*PostInfo)
+	var ids []uint
+	for _, set := range sets {
+		for _, p := range set {
+			if _, ok := byID[p.ID]; !ok {
+				ids = append(ids, p.ID)
+			}
+			byID[p.ID] = append(byID[p.ID], p)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var counts []struct {
+		Post    uint
+		Likes   int
+		Reposts int
+		Replies int
+		Quotes  int
+	}
+	if err := h.db.WithContext(ctx).Raw("SELECT post, likes, reposts, replies, quotes FROM post_counts WHERE post IN ?", ids).Scan(&counts).Error; err != nil {
+		return fmt.Errorf("failed to query post counts: %w", err)
+	}
+
+	for _, c := range counts {
+		for _, p := range byID[c.Post] {
+			p.LikeCount = c.Likes
+			p.RepostCount = c.Reposts
+			p.ReplyCount = c.Replies
+			p.QuoteCount = c.Quotes
+		}
+	}
+
+	return nil
+}
+
+// loadViewerLikes fills in which of the posts the viewer has liked.
+func (h *Hydrator) loadViewerLikes(ctx context.Context, posts map[string]*PostInfo, viewerDID string) error {
+	ctx, span := tracer.Start(ctx, "loadViewerLikes")
+	defer span.End()
+
+	if len(posts) == 0 {
+		return nil
+	}
+
+	byID := make(map[uint]*PostInfo, len(posts))
+	ids := make([]uint, 0, len(posts))
+	for _, p := range posts {
+		byID[p.ID] = p
+		ids = append(ids, p.ID)
+	}
+
+	var likes []struct {
+		Subject uint
+		Rkey    string
+	}
+	if err := h.db.WithContext(ctx).Raw(`
+		SELECT l.subject, l.rkey FROM likes l
+		WHERE l.author = (SELECT id FROM repos WHERE did = ?)
+		AND l.subject IN ?
+	`, viewerDID, ids).Scan(&likes).Error; err != nil {
+		return fmt.Errorf("failed to query viewer likes: %w", err)
+	}
+
+	for _, l := range likes {
+		if p, ok := byID[l.Subject]; ok {
+			p.ViewerLike = fmt.Sprintf("at://%s/app.bsky.feed.like/%s", viewerDID, l.Rkey)
+		}
+	}
+
+	return nil
+}
+
+// loadActors resolves handles and loads profiles for the given DIDs, from the
+// cache where possible. Handles come from the identity directory, which has
+// its own cache.
+func (h *Hydrator) loadActors(ctx context.Context, dids []string) (map[string]*ActorInfo, error) {
+	ctx, span := tracer.Start(ctx, "loadActors")
+	defer span.End()
+
+	out := make(map[string]*ActorInfo, len(dids))
+
+	var active []string
+	gens := make(map[string]uint64, len(dids))
+	seen := make(map[string]bool, len(dids))
+	for _, did := range dids {
+		if seen[did] || !h.accountIsActive(did) {
+			continue
+		}
+		seen[did] = true
+
+		if a, ok := h.cache.getActor(did); ok {
+			out[did] = &a
+			continue
+		}
+
+		gens[did] = h.cache.gen(did)
+		active = append(active, did)
+	}
+
+	if len(active) == 0 {
+		return out, nil
+	}
+
+	var lk sync.Mutex
+	var wg sync.WaitGroup
+	for _, did := range active {
+		wg.Go(func() {
+			resp, err := h.dir.LookupDID(ctx, syntax.DID(did))
+			if err != nil {
+				slog.Warn("failed to lookup DID", "did", did, "error", err)
+				h.addMissingActor(did)
+				return
+			}
+
+			lk.Lock()
+			out[did] = &ActorInfo{
+				DID:    did,
+				Handle: resp.Handle.String(),
+			}
+			lk.Unlock()
+		})
+	}
+
+	var profiles []struct {
+		Did string
+		Raw []byte
+	}
+	err := h.db.WithContext(ctx).Raw(`
+		SELECT r.did, p.raw
+		FROM profiles p
+		JOIN repos r ON r.id = p.repo
+		WHERE r.did IN ?
+	`, active).Scan(&profiles).Error
+
+	wg.Wait()
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to query profiles: %w", err)
+	}
+
+	hasProfile := make(map[string]bool, len(profiles))
+	for _, p := range profiles {
+		if len(p.Raw) == 0 {
+			continue
+		}
+		hasProfile[p.Did] = true
+
+		info, ok := out[p.Did]
+		if !ok {
+			continue
+		}
+
+		var profile bsky.ActorProfile
+		if err := profile.UnmarshalCBOR(bytes.NewReader(p.Raw)); err == nil {
+			info.Profile = &profile
+		}
+	}
+
+	for _, did := range active {
+		info, ok := out[did]
+		if !ok {
+			continue
+		}
+
+		// actors without a profile yet are being fetched, don't hold on to them
+		if !hasProfile[did] {
+			h.addMissingActor(did)
+			continue
+		}
+
+		h.cache.addActor(did, *info, gens[did])
+	}
+
+	return out, nil
+}
+
+// embeddedPostURIs returns the URIs of posts quoted by an embed
+func embeddedPostURIs(embed *bsky.FeedPost_Embed) []string {
+	if embed == nil {
+		return nil
+	}
+
+	var uri string
+	switch {
+	case embed.EmbedRecord != nil && embed.EmbedRecord.Record != nil:
+		uri = embed.EmbedRecord.Record.Uri
+	case embed.EmbedRecordWithMedia != nil && embed.EmbedRecordWithMedia.Record != nil && embed.EmbedRecordWithMedia.Record.Record != nil:
+		uri = embed.EmbedRecordWithMedia.Record.Record.Uri
+	}
+
+	if uri == "" || !isPostURI(uri) {
+		return nil
+	}
+
+	return []string{uri}
+}
@@ -0,0 +1,154 @@
+package hydration
+
+import (
+	"strings"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var hydrationCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "hydration_cache_lookups",
+	Help: "Number of hydration cache lookups, by kind of entry and hit or miss",
+}, []string{"kind", "result"})
+
+const (
+	postCacheSize  = 200_000
+	actorCacheSize = 100_000
+
+	cacheStripes = 256
+)
+
+// hydrationCache keeps hydrated posts and actors between requests. Only the
+// parts that come from the records themselves are cached, counts and viewer
+// state change far more often and are loaded per request.
+//
+// Entries are dropped when the backend tells us the underlying record
+// changed. A request that read the database before such a change must not
+// put its stale result back, so every invalidation bumps a generation
+// counter for the key and fills are only accepted if the counter is where it
+// was when the request started reading.
+type hydrationCache struct {
+	posts  *lru.TwoQueueCache[string, PostInfo]
+	actors *lru.TwoQueueCache[string, ActorInfo]
+
+	gens [cacheStripes]uint64
+	lk   sync.Mutex
+}
+
+func newHydrationCache() *hydrationCache {
+	pc, _ := lru.New2Q[string, PostInfo](postCacheSize)
+	ac, _ := lru.New2Q[string, ActorInfo](actorCacheSize)
+
+	return &hydrationCache{
+		posts:  pc,
+		actors: ac,
+	}
+}
+
+func stripe(key string) int {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % cacheStripes)
+}
+
+// gen returns the generation of a key, to be passed back when filling it
+func (c *hydrationCache) gen(key string) uint64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	return c.gens[stripe(key)]
+}
+
+func (c *hydrationCache) getPost(uri string) (PostInfo, bool) {
+	p, ok := c.posts.Get(uri)
+	recordLookup("post", ok)
+	return p, ok
+}
+
+func (c *hydrationCache) addPost(uri string, p PostInfo, gen uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.gens[stripe(uri)] == gen {
+		c.posts.Add(uri, p)
+	}
+}
+
+func (c *hydrationCache) getActor(did string) (ActorInfo, bool) {
+	a, ok := c.actors.Get(did)
+	recordLookup("actor", ok)
+	return a, ok
+}
+
+func (c *hydrationCache) addActor(did string, a ActorInfo, gen uint64) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if c.gens[stripe(did)] == gen {
+		c.actors.Add(did, a)
+	}
+}
+
+func (c *hydrationCache) invalidatePost(uri string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.gens[stripe(uri)]++
+	c.posts.Remove(uri)
+}
+
+func (c *hydrationCache) invalidateActor(did string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.gens[stripe(did)]++
+	c.actors.Remove(did)
+}
+
+// invalidateActorPosts drops every cached post by an account. It walks the
+// whole cache, which is fine for something as rare as an account being
+// purged.
+func (c *hydrationCache) invalidateActorPosts(did string) {
+	prefix := "at://" + did + "/"
+	for _, uri := range c.posts.Keys() {
+		if strings.HasPrefix(uri, prefix) {
+			c.invalidatePost(uri)
+		}
+	}
+}
+
+func recordLookup(kind string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	hydrationCacheLookups.WithLabelValues(kind, result).Inc()
+}
+
+// RecordChanged implements backend.RecordListener
+func (h *Hydrator) RecordChanged(uri string) {
+	switch {
+	case strings.Contains(uri, "/app.bsky.feed.post/"):
+		h.cache.invalidatePost(uri)
+	case strings.HasSuffix(uri, "/app.bsky.actor.profile/self"):
+		h.cache.invalidateActor(extractDIDFromURI(uri))
+	}
+}
+
+// ActorChanged implements backend.RecordListener
+func (h *Hydrator) ActorChanged(did string) {
+	h.cache.invalidateActor(did)
+}
+
+// ActorPurged implements backend.RecordListener
+func (h *Hydrator) ActorPurged(did string) {
+	h.cache.invalidateActor(did)
+	h.cache.invalidateActorPosts(did)
+}
@@ -1,25 +1,41 @@
 package hydration
 
 import (
+	"errors"
+
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/whyrusleeping/konbini/backend"
 	"gorm.io/gorm"
 )
 
+// ErrAccountInactive is returned when hydrating content belonging to an
+// account that has been deactivated, taken down or deleted
+var ErrAccountInactive = errors.New("account is not active")
+
 // Hydrator handles data hydration from the database
 type Hydrator struct {
 	db      *gorm.DB
 	dir     identity.Directory
 	backend *backend.PostgresBackend
+
+	cache *hydrationCache
 }
 
-// NewHydrator creates a new Hydrator
+// NewHydrator creates a new Hydrator. It registers with the backend to hear
+// about record changes, which keep its cache up to date.
 func NewHydrator(db *gorm.DB, dir identity.Directory, backend *backend.PostgresBackend) *Hydrator {
-	return &Hydrator{
+	h := &Hydrator{
 		db:      db,
 		dir:     dir,
 		backend: backend,
+		cache:   newHydrationCache(),
+	}
+
+	if backend != nil {
+		backend.AddRecordListener(h)
 	}
+
+	return h
 }
 
 // AddMissingRecord reports a missing record that needs to be fetched
@@ -29,6 +45,14 @@ func (h *Hydrator) AddMissingRecord(identifier string, wait bool) {
 	}
 }
 
+// accountIsActive reports whether content from the given account should be shown
+func (h *Hydrator) accountIsActive(did string) bool {
+	if h.backend == nil {
+		return true
+	}
+	return h.backend.AccountIsActive(did)
+}
+
 // addMissingActor is a convenience method for adding missing actors
 func (h *Hydrator) addMissingActor(did string) {
 	h.AddMissingRecord(did, false)
@@ -28,6 +28,7 @@ type PostInfo struct {
 	LikeCount   int
 	RepostCount int
 	ReplyCount  int
+	QuoteCount  int
 	ViewerLike  string // URI of viewer's like, if any
 
 	EmbedInfo *bsky.FeedDefs_PostView_Embed
@@ -52,13 +53,25 @@ func (h *Hydrator) HydratePostDB(ctx context.Context, uri string, dbPost *models
 	autoFetch, _ := ctx.Value("auto-fetch").(bool)
 
 	authorDid := extractDIDFromURI(uri)
+	if !h.accountIsActive(authorDid) {
+		return nil, ErrAccountInactive
+	}
+
 	r, err := h.backend.GetOrCreateRepo(ctx, authorDid)
 	if err != nil {
 		return nil, err
 	}
 
 	if dbPost.NotFound || len(dbPost.Raw) == 0 {
-		if autoFetch {
+		// tombstones of deleted posts aren't worth fetching again
+		var deleted bool
+		if dbPost.ID != 0 {
+			if err := h.db.Raw("SELECT deleted FROM posts WHERE id = ?", dbPost.ID).Scan(&deleted).Error; err != nil {
+				return nil, fmt.Errorf("failed to query post: %w", err)
+			}
+		}
+
+		if autoFetch && !deleted {
 			h.AddMissingRecord(uri, true)
 			if err := h.db.Raw(`SELECT * FROM posts WHERE author = ? AND rkey = ?`, r.ID, extractRkeyFromURI(uri)).Scan(&dbPost).Error; err != nil {
 				return nil, fmt.Errorf("failed to query post: %w", err)
@@ -81,22 +94,17 @@ func (h *Hydrator) HydratePostDB(ctx context.Context, uri string, dbPost *models
 
 	authorDID := r.Did
 
-	// Get engagement counts
-	var likes, reposts, replies int
-	wg.Go(func() {
-		_, span := tracer.Start(ctx, "likeCounts")
-		defer span.End()
-		h.db.Raw("SELECT COUNT(*) FROM likes WHERE subject = ?", dbPost.ID).Scan(&likes)
-	})
-	wg.Go(func() {
-		_, span := tracer.Start(ctx, "repostCounts")
-		defer span.End()
-		h.db.Raw("SELECT COUNT(*) FROM reposts WHERE subject = ?", dbPost.ID).Scan(&reposts)
-	})
+	// Get engagement counts, kept up to date by the backend as records come in
+	var counts struct {
+		Likes   int
+		Reposts int
+		Replies int
+		Quotes  int
+	}
 	wg.Go(func() {
-		_, span := tracer.Start(ctx, "replyCounts")
+		_, span := tracer.Start(ctx, "postCounts")
 		defer span.End()
-		h.db.Raw("SELECT COUNT(*) FROM posts WHERE reply_to = ?", dbPost.ID).Scan(&replies)
+		h.db.Raw("SELECT likes, reposts, replies, quotes FROM post_counts WHERE post = ?", dbPost.ID).Scan(&counts)
 	})
 
 	// Check if viewer liked this post
@@ -131,9 +139,10 @@ func (h *Hydrator) HydratePostDB(ctx context.Context, uri string, dbPost *models
 		ReplyTo:     dbPost.ReplyTo,
 		ReplyToUsr:  dbPost.ReplyToUsr,
 		InThread:    dbPost.InThread,
-		LikeCount:   likes,
-		RepostCount: reposts,
-		ReplyCount:  replies,
+		LikeCount:   counts.Likes,
+		RepostCount: counts.Reposts,
+		ReplyCount:  counts.Replies,
+		QuoteCount:  counts.Quotes,
 		EmbedInfo:   ei,
 	}
 
@@ -153,16 +162,12 @@ func (h *Hydrator) HydratePostDB(ctx context.Context, uri string, dbPost *models
 
 // HydratePosts hydrates multiple posts
 func (h *Hydrator) HydratePosts(ctx context.Context, uris []string, viewerDID string) (map[string]*PostInfo, error) {
-	result := make(map[string]*PostInfo, len(uris))
-	for _, uri := range uris {
-		info, err := h.HydratePost(ctx, uri, viewerDID)
-		if err != nil {
-			// Skip posts that fail to hydrate
-			continue
-		}
-		result[uri] = info
+	b, err := h.HydrateBatch(ctx, uris, nil, viewerDID)
+	if err != nil {
+		return nil, err
 	}
-	return result, nil
+
+	return b.Posts, nil
 }
 
 // Helper functions to extract DID and rkey from AT URI
@@ -201,6 +206,14 @@ func (h *Hydrator) formatEmbed(ctx context.Context, embed *bsky.FeedPost_Embed,
 	_, span := tracer.Start(ctx, "formatEmbed")
 	defer span.End()
 
+	return formatEmbedWith(embed, authorDID, func(uri string) *bsky.EmbedRecord_View_Record {
+		return h.hydrateEmbeddedRecord(ctx, uri, viewerDID)
+	})
+}
+
+// formatEmbedWith builds the view of a post embed, using record to build the
+// view of any embedded record.
+func formatEmbedWith(embed *bsky.FeedPost_Embed, authorDID string, record func(uri string) *bsky.EmbedRecord_View_Record) *bsky.FeedDefs_PostView_Embed {
 	result := &bsky.FeedDefs_PostView_Embed{}
 
 	// Handle images
@@ -287,7 +300,7 @@ func (h *Hydrator) formatEmbed(ctx context.Context, embed *bsky.FeedPost_Embed,
 
 		result.EmbedRecord_View = &bsky.EmbedRecord_View{
 			LexiconTypeID: "app.bsky.embed.record#view",
-			Record:        h.hydrateEmbeddedRecord(ctx, rec.Uri, viewerDID),
+			Record:        record(rec.Uri),
 		}
 		return result
 	}
@@ -302,7 +315,7 @@ func (h *Hydrator) formatEmbed(ctx context.Context, embed *bsky.FeedPost_Embed,
 		if embed.EmbedRecordWithMedia.Record != nil && embed.EmbedRecordWithMedia.Record.Record != nil {
 			recordView.Record = &bsky.EmbedRecord_View{
 				LexiconTypeID: "app.bsky.embed.record#view",
-				Record:        h.hydrateEmbeddedRecord(ctx, embed.EmbedRecordWithMedia.Record.Record.Uri, viewerDID),
+				Record:        record(embed.EmbedRecordWithMedia.Record.Record.Uri),
 			}
 		}
 
@@ -393,33 +406,40 @@ func (h *Hydrator) hydrateEmbeddedRecord(ctx context.Context, uri string, viewer
 
 	// Check if it's a post URI
 	if !isPostURI(uri) {
-		// Could be a feed generator, list, labeler, or starter pack
-		// For now, return not found for non-post embeds
-		return &bsky.EmbedRecord_View_Record{
-			EmbedRecord_ViewNotFound: &bsky.EmbedRecord_ViewNotFound{
-				LexiconTypeID: "app.bsky.embed.record#viewNotFound",
-				Uri:           uri,
-			},
-		}
+		return embeddedRecordView(uri, nil, nil)
 	}
 
 	// Try to hydrate the post
 	quotedPost, err := h.HydratePost(ctx, uri, viewerDID)
 	if err != nil {
-		// Post not found
+		return embeddedRecordView(uri, nil, nil)
+	}
+
+	// Hydrate the author
+	authorInfo, err := h.HydrateActor(ctx, quotedPost.Author)
+	if err != nil {
+		// Author not found, treat as not found
+		return embeddedRecordView(uri, nil, nil)
+	}
+
+	return embeddedRecordView(uri, quotedPost, authorInfo)
+}
+
+// embeddedRecordView builds the view of an embedded record from an already
+// hydrated post and author. Either being nil means the post wasn't found.
+func embeddedRecordView(uri string, quotedPost *PostInfo, authorInfo *ActorInfo) *bsky.EmbedRecord_View_Record {
+	if !isPostURI(uri) {
+		// Could be a feed generator, list, labeler, or starter pack
+		// For now, return not found for non-post embeds
 		return &bsky.EmbedRecord_View_Record{
 			EmbedRecord_ViewNotFound: &bsky.EmbedRecord_ViewNotFound{
 				LexiconTypeID: "app.bsky.embed.record#viewNotFound",
 				Uri:           uri,
-				NotFound:      true,
 			},
 		}
 	}
 
-	// Hydrate the author
-	authorInfo, err := h.HydrateActor(ctx, quotedPost.Author)
-	if err != nil {
-		// Author not found, treat as not found
+	if quotedPost == nil || authorInfo == nil {
 		return &bsky.EmbedRecord_View_Record{
 			EmbedRecord_ViewNotFound: &bsky.EmbedRecord_ViewNotFound{
 				LexiconTypeID: "app.bsky.embed.record#viewNotFound",
@@ -472,6 +492,10 @@ func (h *Hydrator) hydrateEmbeddedRecord(ctx context.Context, uri string, viewer
 		rpc := int64(quotedPost.ReplyCount)
 		embedView.ReplyCount = &rpc
 	}
+	if quotedPost.QuoteCount > 0 {
+		qc := int64(quotedPost.QuoteCount)
+		embedView.QuoteCount = &qc
+	}
 
 	// Note: We don't recursively hydrate embeds for quoted posts to avoid deep nesting
 	// The official app also doesn't show embeds within quoted posts
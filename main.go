@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -16,14 +15,12 @@ import (
 	"sync"
 	"time"
 
-	"github.com/bluesky-social/indigo/api/atproto"
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
 	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/identity/redisdir"
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	"github.com/bluesky-social/indigo/repo"
 	"github.com/bluesky-social/indigo/util/cliutil"
 	xrpclib "github.com/bluesky-social/indigo/xrpc"
-	"github.com/ipfs/go-cid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -44,7 +41,7 @@ import (
 
 var firehoseCursorGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "firehose_cursor",
-}, []string{"stage"})
+}, []string{"host", "stage"})
 
 func main() {
 	app := cli.App{
@@ -72,6 +69,62 @@ func main() {
 		&cli.StringFlag{
 			Name: "sync-config",
 		},
+		&cli.StringSliceFlag{
+			Name:  "local-users",
+			Usage: "DIDs that are served as local users once they authenticate, or * for anyone. The BSKY_HANDLE account is always a local user",
+		},
+		&cli.StringSliceFlag{
+			Name:  "record-collections",
+			Usage: "collections konbini doesn't model to keep in the generic records table, as NSIDs or prefixes like com.example.*",
+		},
+		&cli.IntFlag{
+			Name:  "relevance-depth",
+			Usage: "how far out the follow graph to index: 1 for follows only, 2 to include follows of follows",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "relevance-min-mutuals",
+			Usage: "number of our follows that must follow an account for it to be included at depth 2",
+			Value: 3,
+		},
+		&cli.IntFlag{
+			Name:  "relevance-max-second-degree",
+			Usage: "maximum number of second degree accounts to include, 0 for no limit",
+			Value: 10_000,
+		},
+		&cli.DurationFlag{
+			Name:  "relevance-recompute-interval",
+			Usage: "how often to recompute the relevant set from the follow graph",
+			Value: time.Hour,
+		},
+		&cli.IntFlag{
+			Name:  "backfill-workers",
+			Usage: "number of repos to backfill concurrently",
+			Value: 4,
+		},
+		&cli.Float64Flag{
+			Name:  "backfill-pds-rate",
+			Usage: "maximum repo fetches per second against a single PDS",
+			Value: 2,
+		},
+		&cli.StringFlag{
+			Name:  "oauth-url",
+			Usage: "public URL of the API server, enables logging in with OAuth at <url>/oauth/login instead of BSKY_PASSWORD",
+		},
+		&cli.StringFlag{
+			Name:  "service-did",
+			Usage: "DID of this appview, service auth tokens must be addressed to it. Defaults to the id in did.json",
+		},
+		&cli.IntFlag{
+			Name:  "trending-min-authors",
+			Usage: "number of distinct authors that must use a hashtag before it can trend",
+			Value: 5,
+		},
+		&cli.IntFlag{
+			Name:  "backfill-max-attempts",
+			Usage: "number of attempts before a backfill job is marked as failed",
+			Value: 5,
+		},
 	}
 	app.Action = func(cctx *cli.Context) error {
 		db, err := cliutil.SetupDatabase(cctx.String("db-url"), cctx.Int("max-db-connections"))
@@ -134,9 +187,31 @@ func main() {
 		db.AutoMigrate(Notification{})
 		db.AutoMigrate(NotificationSeen{})
 		db.AutoMigrate(SequenceTracker{})
+		db.AutoMigrate(AccountStatus{})
+		db.AutoMigrate(BackfillJob{})
+		// relevance reasons are unique per local user now
+		db.Exec("DROP INDEX IF EXISTS idx_relevant_dids_did_reason")
+		db.AutoMigrate(RelevantDid{})
+		db.AutoMigrate(LocalUser{})
+		db.AutoMigrate(ActorPreferences{})
+		db.AutoMigrate(Record{})
+		db.AutoMigrate(PostCounts{})
+		db.AutoMigrate(ActorCounts{})
+		db.AutoMigrate(MissingRecordJob{})
+		db.AutoMigrate(PasswordSession{})
+		db.AutoMigrate(OAuthSession{})
+		db.AutoMigrate(OAuthRequest{})
+		db.AutoMigrate(ActorSearch{})
+		db.AutoMigrate(PostSearch{})
+		migrateSearch(db)
 		db.Exec("CREATE INDEX IF NOT EXISTS reposts_subject_idx ON reposts (subject)")
 		db.Exec("CREATE INDEX IF NOT EXISTS posts_reply_to_idx ON posts (reply_to)")
 		db.Exec("CREATE INDEX IF NOT EXISTS posts_in_thread_idx ON posts (in_thread)")
+		// threadgate allow rules are only in the raw record
+		db.Exec("ALTER TABLE thread_gates ADD COLUMN IF NOT EXISTS raw bytea")
+		// deleted posts that are still replied to or quoted are kept as
+		// tombstones
+		db.Exec("ALTER TABLE posts ADD COLUMN IF NOT EXISTS deleted boolean NOT NULL DEFAULT false")
 
 		ctx := context.TODO()
 
@@ -168,7 +243,7 @@ func main() {
 			if err != nil {
 				return err
 			}
-			dir = rdir
+			dir = &layeredDirectory{Directory: rdir, inner: dir}
 		}
 
 		resp, err := dir.LookupHandle(ctx, syntax.Handle(handle))
@@ -181,25 +256,22 @@ func main() {
 			Host: resp.PDSEndpoint(),
 		}
 
-		nsess, err := atproto.ServerCreateSession(ctx, cc, &atproto.ServerCreateSession_Input{
-			Identifier: handle,
-			Password:   password,
-		})
-		if err != nil {
-			return err
+		var oauthApp *oauth.ClientApp
+		if u := strings.TrimSuffix(cctx.String("oauth-url"), "/"); u != "" {
+			oauthApp = newOAuthApp(db, dir, u)
 		}
 
-		cc.Auth = &xrpclib.AuthInfo{
-			AccessJwt:  nsess.AccessJwt,
-			Did:        mydid,
-			Handle:     nsess.Handle,
-			RefreshJwt: nsess.RefreshJwt,
+		sess := newAccountSession(db, dir, resp.DID, password, oauthApp)
+		if err := sess.start(ctx); err != nil {
+			return fmt.Errorf("failed to set up PDS session: %w", err)
 		}
 
 		s := &Server{
-			mydid:  mydid,
-			client: cc,
-			dir:    dir,
+			mydid:   mydid,
+			session: sess,
+			dir:     dir,
+
+			cursors: make(map[string]*cursorTracker),
 
 			db: db,
 		}
@@ -210,6 +282,8 @@ func main() {
 		}
 
 		s.backend = pgb
+		pgb.SetAllowedUsers(cctx.StringSlice("local-users"))
+		pgb.SetRecordCollections(cctx.StringSlice("record-collections"))
 
 		myrepo, err := s.backend.GetOrCreateRepo(ctx, mydid)
 		if err != nil {
@@ -217,10 +291,27 @@ func main() {
 		}
 		s.myrepo = myrepo
 
-		if err := s.backend.LoadRelevantDids(); err != nil {
+		if err := s.backend.LoadRelevantDids(ctx, backend.RelevanceConfig{
+			Depth:             cctx.Int("relevance-depth"),
+			MinMutuals:        cctx.Int("relevance-min-mutuals"),
+			MaxSecondDegree:   cctx.Int("relevance-max-second-degree"),
+			RecomputeInterval: cctx.Duration("relevance-recompute-interval"),
+		}); err != nil {
 			return fmt.Errorf("failed to load relevant dids set: %w", err)
 		}
 
+		if err := s.backend.StartBackfill(ctx, backend.BackfillConfig{
+			Workers:     cctx.Int("backfill-workers"),
+			PDSRate:     cctx.Float64("backfill-pds-rate"),
+			MaxAttempts: cctx.Int("backfill-max-attempts"),
+		}); err != nil {
+			return fmt.Errorf("failed to start backfill: %w", err)
+		}
+
+		s.backend.StartTrending(ctx, backend.TrendingConfig{
+			MinAuthors: cctx.Int("trending-min-authors"),
+		})
+
 		// Start custom API server (for the custom frontend)
 		go func() {
 			if err := s.runApiServer(); err != nil {
@@ -228,9 +319,17 @@ func main() {
 			}
 		}()
 
+		serviceDID := cctx.String("service-did")
+		if serviceDID == "" {
+			serviceDID, err = serviceDIDFromFile("did.json")
+			if err != nil {
+				slog.Warn("no service DID configured, authenticated XRPC requests will be rejected", "error", err)
+			}
+		}
+
 		// Start XRPC server (for official Bluesky app compatibility)
 		go func() {
-			xrpcServer := xrpc.NewServer(db, dir, pgb)
+			xrpcServer := xrpc.NewServer(db, dir, pgb, serviceDID)
 			if err := xrpcServer.Start(":4446"); err != nil {
 				fmt.Println("failed to start XRPC server: ", err)
 			}
@@ -277,31 +376,130 @@ func main() {
 
 	}
 
+	app.Commands = []*cli.Command{
+		{
+			Name:  "repair-counts",
+			Usage: "recompute the like, repost, reply, quote, follow and post counters from the indexed records",
+			Action: func(cctx *cli.Context) error {
+				db, err := cliutil.SetupDatabase(cctx.String("db-url"), cctx.Int("max-db-connections"))
+				if err != nil {
+					return err
+				}
+
+				db.AutoMigrate(PostCounts{})
+				db.AutoMigrate(ActorCounts{})
+
+				pool, err := pgxpool.New(cctx.Context, cctx.String("db-url"))
+				if err != nil {
+					return err
+				}
+				defer pool.Close()
+
+				return backend.RepairCounts(cctx.Context, pool)
+			},
+		},
+		{
+			Name:  "reindex-search",
+			Usage: "rebuild the actor and post search indexes from the indexed profiles and posts",
+			Action: func(cctx *cli.Context) error {
+				db, err := cliutil.SetupDatabase(cctx.String("db-url"), cctx.Int("max-db-connections"))
+				if err != nil {
+					return err
+				}
+
+				db.AutoMigrate(ActorSearch{})
+				db.AutoMigrate(PostSearch{})
+				migrateSearch(db)
+
+				pool, err := pgxpool.New(cctx.Context, cctx.String("db-url"))
+				if err != nil {
+					return err
+				}
+				defer pool.Close()
+
+				if err := backend.ReindexActorSearch(cctx.Context, pool, identity.DefaultDirectory()); err != nil {
+					return err
+				}
+
+				return backend.ReindexPostSearch(cctx.Context, pool)
+			},
+		},
+	}
+
 	app.RunAndExitOnError()
 }
 
+// layeredDirectory is a caching directory wrapped around another cache.
+// Purging it purges both layers, otherwise re-resolving after a purge of the
+// outer cache would just read the stale entry back out of the inner one.
+type layeredDirectory struct {
+	identity.Directory
+	inner identity.Directory
+}
+
+func (ld *layeredDirectory) Purge(ctx context.Context, atid syntax.AtIdentifier) error {
+	if err := ld.inner.Purge(ctx, atid); err != nil {
+		return err
+	}
+
+	return ld.Directory.Purge(ctx, atid)
+}
+
+// migrateSearch sets up the indexes search queries run on: trigrams for fuzzy
+// and prefix matching of handles and display names, full text for profile
+// descriptions and post text, and the post filter arrays.
+func migrateSearch(db *gorm.DB) {
+	db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm")
+	db.Exec("CREATE INDEX IF NOT EXISTS actor_searches_handle_trgm_idx ON actor_searches USING gin (handle gin_trgm_ops)")
+	db.Exec("CREATE INDEX IF NOT EXISTS actor_searches_display_name_trgm_idx ON actor_searches USING gin (display_name gin_trgm_ops)")
+	db.Exec("CREATE INDEX IF NOT EXISTS actor_searches_description_fts_idx ON actor_searches USING gin (to_tsvector('simple', description))")
+	db.Exec("CREATE INDEX IF NOT EXISTS post_searches_text_fts_idx ON post_searches USING gin (to_tsvector('simple', text))")
+	for _, col := range []string{"tags", "mentions", "urls", "domains", "langs"} {
+		db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS post_searches_%[1]s_idx ON post_searches USING gin (%[1]s)", col))
+	}
+}
+
+// serviceDIDFromFile reads our DID from the DID document we serve at
+// /.well-known/did.json
+func serviceDIDFromFile(fname string) (string, error) {
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+
+	var doc struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return "", fmt.Errorf("parsing %s: %w", fname, err)
+	}
+
+	if _, err := syntax.ParseDID(doc.ID); err != nil {
+		return "", fmt.Errorf("%s has no valid id: %w", fname, err)
+	}
+
+	return doc.ID, nil
+}
+
 type Server struct {
 	backend *backend.PostgresBackend
 
 	dir identity.Directory
 
-	client *xrpclib.Client
+	// session of the account we run as, for writing to its repo
+	session *accountSession
+
 	mydid  string
 	myrepo *Repo
 
-	seqLk   sync.Mutex
-	lastSeq int64
+	cursors   map[string]*cursorTracker
+	cursorsLk sync.Mutex
 
 	mpLk sync.Mutex
 
 	db *gorm.DB
 }
 
-func (s *Server) getXrpcClient() (*xrpclib.Client, error) {
-	// TODO: handle refreshing the token periodically
-	return s.client, nil
-}
-
 func (s *Server) resolveAccountIdent(ctx context.Context, acc string) (string, error) {
 	unesc, err := url.PathUnescape(acc)
 	if err != nil {
@@ -321,40 +519,8 @@ func (s *Server) resolveAccountIdent(ctx context.Context, acc string) (string, e
 	return resp.DID.String(), nil
 }
 
-func (s *Server) rescanRepo(ctx context.Context, did string) error {
-	resp, err := s.dir.LookupDID(ctx, syntax.DID(did))
-	if err != nil {
-		return err
-	}
-
-	s.backend.AddRelevantDid(did)
-
-	c := &xrpclib.Client{
-		Host: resp.PDSEndpoint(),
-	}
-
-	repob, err := atproto.SyncGetRepo(ctx, c, did, "")
-	if err != nil {
-		return err
-	}
-
-	rep, err := repo.ReadRepoFromCar(ctx, bytes.NewReader(repob))
-	if err != nil {
-		return err
-	}
-
-	return rep.ForEach(ctx, "", func(k string, v cid.Cid) error {
-		blk, err := rep.Blockstore().Get(ctx, v)
-		if err != nil {
-			slog.Error("record missing in repo", "path", k, "cid", v, "error", err)
-			return nil
-		}
-
-		d := blk.RawData()
-		if err := s.backend.HandleCreate(ctx, did, "", k, &d, &v); err != nil {
-			slog.Error("failed to index record", "path", k, "cid", v, "error", err)
-		}
-		return nil
-	})
+func (s *Server) rescanRepo(ctx context.Context, did string) (*BackfillJob, error) {
+	s.backend.AddRelevantDid(did, backend.RelevanceManual)
 
+	return s.backend.EnqueueBackfill(ctx, did, "rescan")
 }
@@ -21,6 +21,7 @@ type FeedGenerator = models.FeedGenerator
 type Image = models.Image
 type PostGate = models.PostGate
 type StarterPack = models.StarterPack
+type PostCounts = models.PostCounts
 
 type Like struct {
 	ID      uint `gorm:"primarykey"`
@@ -52,3 +53,148 @@ type NotificationSeen struct {
 	Repo   uint `gorm:"uniqueindex"`
 	SeenAt time.Time
 }
+
+// AccountStatus records repos whose hosting status is not active. Active
+// accounts have no row here.
+type AccountStatus struct {
+	Repo      uint `gorm:"primarykey;autoIncrement:false"`
+	Status    string
+	UpdatedAt time.Time
+}
+
+// BackfillJob tracks a full repo fetch. There is at most one job per DID,
+// finished jobs are reset to pending when the DID is enqueued again.
+type BackfillJob struct {
+	ID          uint   `gorm:"primarykey"`
+	Did         string `gorm:"uniqueIndex"`
+	State       string `gorm:"index"`
+	Reason      string
+	Attempts    int
+	Records     int64
+	Bytes       int64
+	Added       int64
+	Removed     int64
+	Rev         string
+	Error       string
+	NextAttempt time.Time
+	StartedAt   *time.Time
+	FinishedAt  *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// RelevantDid records why an account is in the relevant set, with one row per
+// reason. Reasons that come from a local user's follow graph record that user
+// in LocalUser. Pinned accounts are never dropped from the set automatically.
+type RelevantDid struct {
+	ID        uint   `gorm:"primarykey"`
+	Did       string `gorm:"uniqueIndex:idx_relevant_dids_did_reason_user"`
+	Reason    string `gorm:"uniqueIndex:idx_relevant_dids_did_reason_user;index"`
+	LocalUser string `gorm:"uniqueIndex:idx_relevant_dids_did_reason_user;index;not null;default:''"`
+	Pinned    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// LocalUser is an account served by this instance. Each local user gets their
+// own follow graph derived relevance, notifications and preferences.
+type LocalUser struct {
+	ID        uint   `gorm:"primarykey"`
+	Did       string `gorm:"uniqueIndex"`
+	Repo      uint
+	CreatedAt time.Time
+}
+
+// ActorPreferences holds the app.bsky.actor preferences of a local user, as
+// the JSON array sent to putPreferences.
+type ActorPreferences struct {
+	Repo      uint `gorm:"primarykey;autoIncrement:false"`
+	Raw       []byte
+	UpdatedAt time.Time
+}
+
+// Record holds a record from a collection konbini doesn't otherwise model, as
+// the raw CBOR from the repo.
+type Record struct {
+	ID         uint   `gorm:"primarykey"`
+	Author     uint   `gorm:"uniqueIndex:idx_records_author_collection_rkey"`
+	Collection string `gorm:"uniqueIndex:idx_records_author_collection_rkey;index"`
+	Rkey       string `gorm:"uniqueIndex:idx_records_author_collection_rkey"`
+	Cid        string
+	Raw        []byte
+	Indexed    time.Time
+}
+
+// ActorCounts holds the follow and post counters of an account. Like
+// PostCounts they are kept up to date by the event handlers and can be
+// rebuilt with the repair-counts command.
+type ActorCounts struct {
+	Repo      uint `gorm:"primarykey;autoIncrement:false"`
+	Follows   int64
+	Followers int64
+	Posts     int64
+}
+
+// MissingRecordJob is a referenced record we don't have yet, queued to be
+// fetched from its PDS. The row is removed once the record is fetched, turns
+// out not to exist, or has failed too many times.
+type MissingRecordJob struct {
+	ID          uint   `gorm:"primarykey"`
+	Identifier  string `gorm:"uniqueIndex"`
+	Type        string
+	Attempts    int
+	Error       string
+	NextAttempt time.Time `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+// PasswordSession is the saved app password session of the account konbini
+// runs as. Data is the JSON encoded session with its access and refresh
+// tokens.
+type PasswordSession struct {
+	Did       string `gorm:"primarykey"`
+	Data      []byte
+	UpdatedAt time.Time
+}
+
+// OAuthSession is an OAuth session of the account konbini runs as, Data is
+// the JSON encoded session data kept by the OAuth client.
+type OAuthSession struct {
+	Did       string `gorm:"primarykey"`
+	SessionID string `gorm:"primarykey"`
+	Data      []byte
+	UpdatedAt time.Time
+}
+
+// OAuthRequest is an OAuth login that has been started but hasn't come back
+// through the callback yet.
+type OAuthRequest struct {
+	State     string `gorm:"primarykey"`
+	Data      []byte
+	CreatedAt time.Time
+}
+
+// ActorSearch is the search entry of an account, with the handle from its DID
+// document and the text fields of its profile.
+type ActorSearch struct {
+	Repo        uint `gorm:"primarykey;autoIncrement:false"`
+	Handle      string
+	DisplayName string
+	Description string
+	UpdatedAt   time.Time
+}
+
+// PostSearch is the search entry of a post. Alongside the text it holds the
+// hashtags, mentioned DIDs, links, link domains and languages of the post,
+// normalized the way searchPosts filters on them.
+type PostSearch struct {
+	Post     uint      `gorm:"primarykey;autoIncrement:false"`
+	Author   uint      `gorm:"index:idx_post_searches_author_created"`
+	Created  time.Time `gorm:"index:idx_post_searches_author_created;index"`
+	Text     string
+	Tags     []string `gorm:"type:text[]"`
+	Mentions []string `gorm:"type:text[]"`
+	Urls     []string `gorm:"type:text[]"`
+	Domains  []string `gorm:"type:text[]"`
+	Langs    []string `gorm:"type:text[]"`
+}
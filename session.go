@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/atclient"
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/identity"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	. "github.com/whyrusleeping/konbini/models"
+)
+
+var errNoSession = errors.New("not logged in to the PDS, set BSKY_PASSWORD or log in at /oauth/login")
+
+const (
+	// password sessions are refreshed when their access token has less than
+	// this long left
+	sessionRefreshMargin = time.Minute * 10
+
+	sessionCheckInterval = time.Minute
+)
+
+// accountSession is the authenticated session of the account konbini runs as,
+// used to write records on its behalf. It is either an app password session,
+// which we refresh before the access token expires, or an OAuth session,
+// which refreshes itself. Both kinds are saved in the database so restarts
+// don't need a new login.
+type accountSession struct {
+	db  *gorm.DB
+	dir identity.Directory
+	did syntax.DID
+
+	password string
+
+	// set if OAuth logins are configured
+	oauth *oauth.ClientApp
+
+	client *atclient.APIClient
+	lk     sync.RWMutex
+}
+
+func newAccountSession(db *gorm.DB, dir identity.Directory, did syntax.DID, password string, oauthApp *oauth.ClientApp) *accountSession {
+	return &accountSession{
+		db:       db,
+		dir:      dir,
+		did:      did,
+		password: password,
+		oauth:    oauthApp,
+	}
+}
+
+// start resumes the saved session, logging in again if needed. With an app
+// password it also starts refreshing the session in the background.
+func (as *accountSession) start(ctx context.Context) error {
+	if as.password != "" {
+		if err := as.resumePassword(ctx); err != nil {
+			return err
+		}
+
+		go as.refreshLoop(ctx)
+		return nil
+	}
+
+	if as.oauth == nil {
+		return fmt.Errorf("BSKY_PASSWORD is required unless OAuth logins are configured")
+	}
+
+	var sess OAuthSession
+	if err := as.db.WithContext(ctx).Where("did = ?", as.did.String()).Order("updated_at DESC").Limit(1).Find(&sess).Error; err != nil {
+		return fmt.Errorf("loading oauth session: %w", err)
+	}
+
+	if sess.SessionID == "" {
+		slog.Warn("no session for our account, log in at /oauth/login to enable writes", "did", as.did)
+		return nil
+	}
+
+	return as.useOAuthSession(ctx, sess.SessionID)
+}
+
+func (as *accountSession) getClient() (*atclient.APIClient, error) {
+	as.lk.RLock()
+	defer as.lk.RUnlock()
+
+	if as.client == nil {
+		return nil, errNoSession
+	}
+
+	return as.client, nil
+}
+
+func (as *accountSession) setClient(c *atclient.APIClient) {
+	as.lk.Lock()
+	defer as.lk.Unlock()
+
+	as.client = c
+}
+
+// Post makes a procedure call as our account. A call that fails because the
+// session expired beyond refreshing is retried once after logging in again.
+func (as *accountSession) Post(ctx context.Context, endpoint syntax.NSID, body, out any) error {
+	c, err := as.getClient()
+	if err != nil {
+		return err
+	}
+
+	err = c.Post(ctx, endpoint, body, out)
+	if !isExpiredSession(err) || as.password == "" {
+		return err
+	}
+
+	slog.Warn("session expired, logging in again", "error", err)
+	if err := as.login(ctx); err != nil {
+		return err
+	}
+
+	c, err = as.getClient()
+	if err != nil {
+		return err
+	}
+
+	return c.Post(ctx, endpoint, body, out)
+}
+
+func isExpiredSession(err error) bool {
+	var ae *atclient.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+
+	return ae.Name == "ExpiredToken" || ae.Name == "InvalidToken"
+}
+
+func (as *accountSession) resumePassword(ctx context.Context) error {
+	var saved PasswordSession
+	if err := as.db.WithContext(ctx).Where("did = ?", as.did.String()).Limit(1).Find(&saved).Error; err != nil {
+		return fmt.Errorf("loading saved session: %w", err)
+	}
+
+	if saved.Did == "" {
+		return as.login(ctx)
+	}
+
+	var data atclient.PasswordSessionData
+	if err := json.Unmarshal(saved.Data, &data); err != nil {
+		slog.Warn("failed to decode saved session, logging in again", "error", err)
+		return as.login(ctx)
+	}
+
+	as.setClient(atclient.ResumePasswordSession(data, as.savePassword))
+
+	// the saved tokens may have expired while we were down
+	return as.refreshIfExpiring(ctx)
+}
+
+func (as *accountSession) login(ctx context.Context) error {
+	c, err := atclient.LoginWithPassword(ctx, as.dir, as.did.AtIdentifier(), as.password, "", as.savePassword)
+	if err != nil {
+		return fmt.Errorf("logging in: %w", err)
+	}
+
+	pa, ok := c.Auth.(*atclient.PasswordAuth)
+	if !ok {
+		return fmt.Errorf("password login returned unexpected auth method %T", c.Auth)
+	}
+
+	as.setClient(c)
+	as.savePassword(ctx, pa.Session.Clone())
+
+	slog.Info("logged in to PDS", "did", as.did, "host", c.Host)
+	return nil
+}
+
+// savePassword is the refresh callback of password sessions
+func (as *accountSession) savePassword(ctx context.Context, data atclient.PasswordSessionData) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to encode session", "error", err)
+		return
+	}
+
+	if err := as.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&PasswordSession{
+		Did:       data.AccountDID.String(),
+		Data:      b,
+		UpdatedAt: time.Now(),
+	}).Error; err != nil {
+		slog.Error("failed to save session", "error", err)
+	}
+}
+
+func (as *accountSession) refreshLoop(ctx context.Context) {
+	tick := time.NewTicker(sessionCheckInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := as.refreshIfExpiring(ctx); err != nil {
+			slog.Error("failed to refresh session", "error", err)
+		}
+	}
+}
+
+// refreshIfExpiring refreshes a password session whose access token is about
+// to expire. If the refresh token has expired as well we log in again.
+func (as *accountSession) refreshIfExpiring(ctx context.Context) error {
+	c, err := as.getClient()
+	if err != nil {
+		return err
+	}
+
+	pa, ok := c.Auth.(*atclient.PasswordAuth)
+	if !ok {
+		// OAuth sessions take care of themselves
+		return nil
+	}
+
+	access, refresh := pa.GetTokens()
+	exp, err := tokenExpiry(access)
+	if err != nil {
+		return err
+	}
+
+	if time.Until(exp) > sessionRefreshMargin {
+		return nil
+	}
+
+	if err := pa.Refresh(ctx, c.Client, refresh); err != nil {
+		slog.Warn("failed to refresh session, logging in again", "error", err)
+		return as.login(ctx)
+	}
+
+	return nil
+}
+
+func tokenExpiry(tok string) (time.Time, error) {
+	t, err := jwt.Parse([]byte(tok), jwt.WithVerify(false), jwt.WithValidate(false))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse access token: %w", err)
+	}
+
+	return t.Expiration(), nil
+}
+
+// useOAuthSession switches to the given OAuth session
+func (as *accountSession) useOAuthSession(ctx context.Context, sessionID string) error {
+	sess, err := as.oauth.ResumeSession(ctx, as.did, sessionID)
+	if err != nil {
+		return fmt.Errorf("resuming oauth session: %w", err)
+	}
+
+	as.setClient(sess.APIClient())
+
+	slog.Info("using oauth session", "did", as.did, "host", sess.Data.HostURL)
+	return nil
+}
+
+var oauthScopes = []string{"atproto", "transition:generic"}
+
+// newOAuthApp sets up OAuth logins for the API server reachable at publicURL.
+// For a localhost URL the special development client is used, which doesn't
+// need the client metadata to be reachable by the PDS.
+func newOAuthApp(db *gorm.DB, dir identity.Directory, publicURL string) *oauth.ClientApp {
+	callback := publicURL + "/oauth/callback"
+
+	var cfg oauth.ClientConfig
+	if u, err := url.Parse(publicURL); err == nil && (u.Hostname() == "localhost" || u.Hostname() == "127.0.0.1") {
+		cfg = oauth.NewLocalhostConfig(callback, oauthScopes)
+	} else {
+		cfg = oauth.NewPublicConfig(publicURL+"/oauth/client-metadata.json", callback, oauthScopes)
+	}
+
+	app := oauth.NewClientApp(&cfg, &oauthStore{db: db})
+	app.Dir = dir
+	return app
+}
+
+// oauthStore keeps OAuth sessions and pending logins in the database
+type oauthStore struct {
+	db *gorm.DB
+}
+
+var _ oauth.ClientAuthStore = (*oauthStore)(nil)
+
+// logins that haven't come back by then are abandoned
+const oauthRequestTTL = time.Hour
+
+func (s *oauthStore) GetSession(ctx context.Context, did syntax.DID, sessionID string) (*oauth.ClientSessionData, error) {
+	var sess OAuthSession
+	if err := s.db.WithContext(ctx).Where("did = ? AND session_id = ?", did.String(), sessionID).Take(&sess).Error; err != nil {
+		return nil, fmt.Errorf("loading oauth session for %s: %w", did, err)
+	}
+
+	var data oauth.ClientSessionData
+	if err := json.Unmarshal(sess.Data, &data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+func (s *oauthStore) SaveSession(ctx context.Context, sess oauth.ClientSessionData) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&OAuthSession{
+		Did:       sess.AccountDID.String(),
+		SessionID: sess.SessionID,
+		Data:      b,
+		UpdatedAt: time.Now(),
+	}).Error
+}
+
+func (s *oauthStore) DeleteSession(ctx context.Context, did syntax.DID, sessionID string) error {
+	return s.db.WithContext(ctx).Where("did = ? AND session_id = ?", did.String(), sessionID).Delete(&OAuthSession{}).Error
+}
+
+func (s *oauthStore) GetAuthRequestInfo(ctx context.Context, state string) (*oauth.AuthRequestData, error) {
+	var req OAuthRequest
+	if err := s.db.WithContext(ctx).Where("state = ? AND created_at > ?", state, time.Now().Add(-oauthRequestTTL)).Take(&req).Error; err != nil {
+		return nil, fmt.Errorf("loading oauth request: %w", err)
+	}
+
+	var data oauth.AuthRequestData
+	if err := json.Unmarshal(req.Data, &data); err != nil {
+		return nil, err
+	}
+
+	return &data, nil
+}
+
+func (s *oauthStore) SaveAuthRequestInfo(ctx context.Context, info oauth.AuthRequestData) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	// clear out abandoned logins while we're here
+	if err := s.db.WithContext(ctx).Where("created_at < ?", time.Now().Add(-oauthRequestTTL)).Delete(&OAuthRequest{}).Error; err != nil {
+		slog.Warn("failed to delete old oauth requests", "error", err)
+	}
+
+	return s.db.WithContext(ctx).Create(&OAuthRequest{
+		State:     info.State,
+		Data:      b,
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+func (s *oauthStore) DeleteAuthRequestInfo(ctx context.Context, state string) error {
+	return s.db.WithContext(ctx).Where("state = ?", state).Delete(&OAuthRequest{}).Error
+}
@@ -25,6 +25,12 @@ type SyncBackend struct {
 	Type       string `json:"type"`
 	Host       string `json:"host"`
 	MaxWorkers int    `json:"max_workers,omitempty"`
+
+	// Verify enables signature and MST verification of commits. This is
+	// required when subscribing directly to untrusted PDSs. #account,
+	// #identity and #sync events are only accepted for accounts hosted on
+	// the backend's host. Only supported for firehose backends.
+	Verify bool `json:"verify,omitempty"`
 }
 
 func (s *Server) StartSyncEngine(ctx context.Context, sc *SyncConfig) error {
@@ -33,6 +39,9 @@ func (s *Server) StartSyncEngine(ctx context.Context, sc *SyncConfig) error {
 		case "firehose":
 			go s.runSyncFirehose(ctx, be)
 		case "jetstream":
+			if be.Verify {
+				return fmt.Errorf("jetstream backend %q cannot be verified, use a firehose backend instead", be.Host)
+			}
 			go s.runSyncJetstream(ctx, be)
 		default:
 			return fmt.Errorf("unrecognized sync backend type: %q", be.Type)
@@ -59,7 +68,7 @@ func (s *Server) runSyncFirehose(ctx context.Context, be SyncBackend) {
 		}
 
 		start := time.Now()
-		if err := s.startLiveTail(ctx, be.Host, int(seqno), maxWorkers, 20); err != nil {
+		if err := s.startLiveTail(ctx, be.Host, int(seqno), maxWorkers, 20, be.Verify); err != nil {
 			slog.Error("firehose connection lost", "host", be.Host, "error", err)
 		}
 
@@ -118,11 +127,11 @@ func delayForFailureCount(n int) time.Duration {
 	return time.Second * 30
 }
 
-func (s *Server) startLiveTail(ctx context.Context, host string, curs int, parWorkers, maxQ int) error {
+func (s *Server) startLiveTail(ctx context.Context, host string, curs int, parWorkers, maxQ int, verify bool) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	slog.Info("starting live tail")
+	slog.Info("starting live tail", "host", host, "verify", verify)
 
 	// Connect to the Relay websocket
 	urlStr := fmt.Sprintf("wss://%s/xrpc/com.atproto.sync.subscribeRepos?cursor=%d", host, curs)
@@ -159,45 +168,62 @@ func (s *Server) startLiveTail(ctx context.Context, host string, curs int, parWo
 		}
 	}()
 
-	var cclk sync.Mutex
-	var completeCursor int64
+	ct, stopTracker := s.startCursorTracker(host, int64(curs))
+	// runs after HandleRepoStream has shut the scheduler down, so every
+	// event that will ever complete has been marked done
+	defer stopTracker()
 
 	rsc := &stream.RepoStreamCallbacks{
 		RepoCommit: func(evt *atproto.SyncSubscribeRepos_Commit) error {
 			ctx := context.Background()
 
-			firehoseCursorGauge.WithLabelValues("ingest").Set(float64(evt.Seq))
-
-			s.seqLk.Lock()
-			if evt.Seq > s.lastSeq {
-				curs = int(evt.Seq)
-				s.lastSeq = evt.Seq
-
-				if evt.Seq%1000 == 0 {
-					if err := storeLastSeq(s.db, host, evt.Seq); err != nil {
-						fmt.Println("failed to store seqno: ", err)
-					}
-				}
-			}
-			s.seqLk.Unlock()
-
 			lelk.Lock()
 			lastEvent = time.Now()
 			lelk.Unlock()
 
-			if err := s.backend.HandleEvent(ctx, evt); err != nil {
-				return fmt.Errorf("handle event (%s,%d): %w", evt.Repo, evt.Seq, err)
+			var rejected bool
+			if verify {
+				if err := s.backend.VerifyCommit(ctx, host, evt); err != nil {
+					slog.Warn("rejecting unverified commit", "host", host, "repo", evt.Repo, "seq", evt.Seq, "error", err)
+					rejected = true
+				}
 			}
 
-			cclk.Lock()
-			if evt.Seq > completeCursor {
-				completeCursor = evt.Seq
-				firehoseCursorGauge.WithLabelValues("complete").Set(float64(evt.Seq))
+			if !rejected {
+				if err := s.backend.HandleEvent(ctx, evt); err != nil {
+					return fmt.Errorf("handle event (%s,%d): %w", evt.Repo, evt.Seq, err)
+				}
 			}
-			cclk.Unlock()
 
 			return nil
 		},
+		RepoAccount: func(evt *atproto.SyncSubscribeRepos_Account) error {
+			if verify && !s.verifyEventHost(host, evt.Did, evt.Seq, "account") {
+				return nil
+			}
+			if err := s.backend.HandleAccountEvent(context.Background(), evt); err != nil {
+				return fmt.Errorf("handle account event (%s,%d): %w", evt.Did, evt.Seq, err)
+			}
+			return nil
+		},
+		RepoSync: func(evt *atproto.SyncSubscribeRepos_Sync) error {
+			if verify && !s.verifyEventHost(host, evt.Did, evt.Seq, "sync") {
+				return nil
+			}
+			if err := s.backend.HandleSyncEvent(context.Background(), evt); err != nil {
+				return fmt.Errorf("handle sync event (%s,%d): %w", evt.Did, evt.Seq, err)
+			}
+			return nil
+		},
+		RepoIdentity: func(evt *atproto.SyncSubscribeRepos_Identity) error {
+			if verify && !s.verifyEventHost(host, evt.Did, evt.Seq, "identity") {
+				return nil
+			}
+			if err := s.backend.HandleIdentityEvent(context.Background(), evt); err != nil {
+				return fmt.Errorf("handle identity event (%s,%d): %w", evt.Did, evt.Seq, err)
+			}
+			return nil
+		},
 		RepoInfo: func(info *atproto.SyncSubscribeRepos_Info) error {
 			return nil
 		},
@@ -207,55 +233,78 @@ func (s *Server) startLiveTail(ctx context.Context, host string, curs int, parWo
 		},
 	}
 
-	sched := parallel.NewScheduler(parWorkers, maxQ, con.RemoteAddr().String(), rsc.EventHandler)
+	handler := func(ctx context.Context, xev *stream.XRPCStreamEvent) error {
+		// errors are logged by the scheduler and the event is not retried,
+		// so it counts as done either way
+		if seq, ok := streamEventSeq(xev); ok {
+			defer ct.Done(seq)
+		}
+		return rsc.EventHandler(ctx, xev)
+	}
+
+	sched := &trackedScheduler{
+		Scheduler: parallel.NewScheduler(parWorkers, maxQ, con.RemoteAddr().String(), handler),
+		ct:        ct,
+	}
 
 	return stream.HandleRepoStream(ctx, con, sched, slog.Default())
 }
 
+// verifyEventHost reports whether an unsigned event from a verified backend
+// should be processed. Only the PDS hosting an account may speak for it.
+func (s *Server) verifyEventHost(host, did string, seq int64, kind string) bool {
+	if err := s.backend.VerifyEventHost(context.Background(), host, did); err != nil {
+		slog.Warn("rejecting event from unauthoritative host", "kind", kind, "host", host, "did", did, "seq", seq, "error", err)
+		return false
+	}
+	return true
+}
+
 func (s *Server) startJetstreamTail(ctx context.Context, host string, cursor int64, parWorkers int) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	slog.Info("starting jetstream tail", "host", host, "cursor", cursor)
 
+	ct, stopTracker := s.startCursorTracker(host, cursor)
+	defer stopTracker()
+
 	// Create a scheduler for parallel processing
-	lastStored := int64(0)
-	sched := jsparallel.NewScheduler(
+	jsched := jsparallel.NewScheduler(
 		parWorkers,
 		host,
 		slog.Default(),
 		func(ctx context.Context, event *models.Event) error {
-			// Update cursor tracking
-			s.seqLk.Lock()
-			if event.TimeUS > s.lastSeq {
-				s.lastSeq = event.TimeUS
-				if event.TimeUS-lastStored > 1_000_000 {
-					// Store checkpoint periodically
-					if err := storeLastSeq(s.db, host, event.TimeUS); err != nil {
-						slog.Error("failed to store jetstream cursor", "error", err)
-					}
-					lastStored = event.TimeUS
-				}
-			}
-			s.seqLk.Unlock()
-
-			// Update metrics
-			firehoseCursorGauge.WithLabelValues("ingest").Set(float64(event.TimeUS))
+			defer ct.Done(event.TimeUS)
 
 			// Convert Jetstream event to ATProto event format
 			if event.Commit != nil {
-
 				if err := s.backend.HandleEventJetstream(ctx, event); err != nil {
 					return fmt.Errorf("handle event (%s,%d): %w", event.Did, event.TimeUS, err)
 				}
+			}
+
+			if event.Account != nil {
+				if err := s.backend.HandleAccountEvent(ctx, event.Account); err != nil {
+					return fmt.Errorf("handle account event (%s,%d): %w", event.Did, event.TimeUS, err)
+				}
+			}
 
-				firehoseCursorGauge.WithLabelValues("complete").Set(float64(event.TimeUS))
+			if event.Identity != nil {
+				if err := s.backend.HandleIdentityEvent(ctx, event.Identity); err != nil {
+					return fmt.Errorf("handle identity event (%s,%d): %w", event.Did, event.TimeUS, err)
+				}
 			}
 
 			return nil
 		},
 	)
 
+	sched := &trackedJetstreamScheduler{
+		jetstreamScheduler: jsched,
+		ct:                 ct,
+	}
+
 	// Configure Jetstream client
 	config := jsclient.DefaultClientConfig()
 	config.WebsocketURL = fmt.Sprintf("wss://%s/subscribe", host)
@@ -273,9 +322,13 @@ func (s *Server) startJetstreamTail(ctx context.Context, host string, cursor int
 		sched,
 	)
 	if err != nil {
+		jsched.Shutdown()
 		return fmt.Errorf("create jetstream client: %w", err)
 	}
 
-	// Start reading from Jetstream
-	return client.ConnectAndRead(ctx, cursorPtr)
+	// Start reading from Jetstream. Unlike the firehose consumer, the
+	// jetstream client leaves shutting down the scheduler to us
+	err = client.ConnectAndRead(ctx, cursorPtr)
+	jsched.Shutdown()
+	return err
 }
@@ -34,6 +34,10 @@ func PostView(post *hydration.PostInfo, author *hydration.ActorInfo) *bsky.FeedD
 		rpc := int64(post.ReplyCount)
 		view.ReplyCount = &rpc
 	}
+	if post.QuoteCount > 0 {
+		qc := int64(post.QuoteCount)
+		view.QuoteCount = &qc
+	}
 
 	// Add viewer state
 	if post.ViewerLike != "" {
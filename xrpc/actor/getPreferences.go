@@ -1,17 +1,20 @@
 package actor
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/labstack/echo/v4"
 	"github.com/whyrusleeping/konbini/hydration"
+	"github.com/whyrusleeping/konbini/models"
 	"gorm.io/gorm"
 )
 
 // HandleGetPreferences implements app.bsky.actor.getPreferences
-// This is typically a PDS endpoint, not an AppView endpoint.
-// For now, return empty preferences.
+// This is typically a PDS endpoint, not an AppView endpoint. We return what
+// the viewer last stored with putPreferences, or a set of defaults if they
+// never have.
 func HandleGetPreferences(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
 	// Get viewer from authentication
 	viewer := c.Get("viewer")
@@ -22,6 +25,22 @@ func HandleGetPreferences(c echo.Context, db *gorm.DB, hydrator *hydration.Hydra
 		})
 	}
 
+	var prefs models.ActorPreferences
+	if err := db.Raw("SELECT * FROM actor_preferences WHERE repo = (SELECT id FROM repos WHERE did = ?)", viewer.(string)).Scan(&prefs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to load preferences",
+		})
+	}
+
+	if prefs.Repo != 0 {
+		// stored as sent, so preferences we don't have lexicon types for
+		// round trip untouched
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"preferences": json.RawMessage(prefs.Raw),
+		})
+	}
+
 	out := bsky.ActorGetPreferences_Output{
 		Preferences: []bsky.ActorDefs_Preferences_Elem{
 			{
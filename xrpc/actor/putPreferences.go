@@ -1,15 +1,21 @@
 package actor
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/whyrusleeping/konbini/hydration"
+	"github.com/whyrusleeping/konbini/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // HandlePutPreferences implements app.bsky.actor.putPreferences
-// Stubbed out for now - just returns success without doing anything
+// The preferences are stored as sent and replace whatever the viewer had
+// stored before.
 func HandlePutPreferences(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
 	// Get viewer from authentication
 	viewer := c.Get("viewer")
@@ -20,6 +26,45 @@ func HandlePutPreferences(c echo.Context, db *gorm.DB, hydrator *hydration.Hydra
 		})
 	}
 
-	// For now, just return success without storing anything
+	var input struct {
+		Preferences json.RawMessage `json:"preferences"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&input); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "InvalidRequest",
+			"message": "invalid request body",
+		})
+	}
+
+	if !bytes.HasPrefix(bytes.TrimSpace(input.Preferences), []byte("[")) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "InvalidRequest",
+			"message": "preferences must be an array",
+		})
+	}
+
+	var repo models.Repo
+	if err := db.Find(&repo, "did = ?", viewer.(string)).Error; err != nil || repo.ID == 0 {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to find viewer repo",
+		})
+	}
+
+	prefs := models.ActorPreferences{
+		Repo:      repo.ID,
+		Raw:       input.Preferences,
+		UpdatedAt: time.Now(),
+	}
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "repo"}},
+		DoUpdates: clause.AssignmentColumns([]string{"raw", "updated_at"}),
+	}).Create(&prefs).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to store preferences",
+		})
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{})
 }
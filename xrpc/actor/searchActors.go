@@ -0,0 +1,190 @@
+package actor
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bluesky-social/indigo/api/bsky"
+	"github.com/labstack/echo/v4"
+	"github.com/whyrusleeping/konbini/hydration"
+	"github.com/whyrusleeping/konbini/views"
+	"gorm.io/gorm"
+)
+
+// Matches are ranked by how similar the handle or display name is to the
+// query, with a boost for accounts the viewer follows and a smaller one for
+// accounts that follow the viewer. Inactive accounts are left out.
+const searchActorsQuery = `
+SELECT r.did
+FROM actor_searches s
+JOIN repos r ON r.id = s.repo
+WHERE (s.handle % @q OR s.display_name % @q
+	OR s.handle LIKE @prefix OR s.display_name ILIKE @prefix
+	OR to_tsvector('simple', s.description) @@ plainto_tsquery('simple', @q))
+AND NOT EXISTS (SELECT 1 FROM account_statuses a WHERE a.repo = s.repo)
+ORDER BY GREATEST(similarity(s.handle, @q), similarity(s.display_name, @q))
+	+ CASE WHEN s.handle LIKE @prefix OR s.display_name ILIKE @prefix THEN 0.5 ELSE 0 END
+	+ CASE WHEN EXISTS (SELECT 1 FROM follows f WHERE f.author = @viewer AND f.subject = s.repo) THEN 1 ELSE 0 END
+	+ CASE WHEN EXISTS (SELECT 1 FROM follows f WHERE f.author = s.repo AND f.subject = @viewer) THEN 0.5 ELSE 0 END
+	DESC, s.repo
+LIMIT @limit OFFSET @offset
+`
+
+// Typeahead only matches the start of handles and display names, so results
+// show up as soon as the first few characters are typed.
+const searchActorsTypeaheadQuery = `
+SELECT r.did
+FROM actor_searches s
+JOIN repos r ON r.id = s.repo
+WHERE (s.handle LIKE @prefix OR s.display_name ILIKE @prefix OR s.display_name ILIKE @word)
+AND NOT EXISTS (SELECT 1 FROM account_statuses a WHERE a.repo = s.repo)
+ORDER BY CASE WHEN EXISTS (SELECT 1 FROM follows f WHERE f.author = @viewer AND f.subject = s.repo) THEN 1 ELSE 0 END
+	+ CASE WHEN EXISTS (SELECT 1 FROM follows f WHERE f.author = s.repo AND f.subject = @viewer) THEN 0.5 ELSE 0 END
+	+ GREATEST(similarity(s.handle, @q), similarity(s.display_name, @q))
+	DESC, s.repo
+LIMIT @limit
+`
+
+// HandleSearchActors implements app.bsky.actor.searchActors
+func HandleSearchActors(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
+	q := searchTerm(c)
+	if q == "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"actors": []*bsky.ActorDefs_ProfileView{},
+		})
+	}
+
+	// Parse limit
+	limit := 25
+	if limitParam := c.QueryParam("limit"); limitParam != "" {
+		if l, err := strconv.Atoi(limitParam); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	// Results are ranked, so the cursor is an offset into them
+	offset := 0
+	if cursorParam := c.QueryParam("cursor"); cursorParam != "" {
+		if o, err := strconv.Atoi(cursorParam); err == nil && o > 0 {
+			offset = o
+		}
+	}
+
+	ctx := c.Request().Context()
+	viewer, _ := c.Get("viewer").(string)
+
+	var dids []string
+	if err := db.Raw(searchActorsQuery, searchArgs(db, q, viewer, limit, offset)).Scan(&dids).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to search actors",
+		})
+	}
+
+	actors, err := hydrator.HydrateActors(ctx, dids)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to load actors",
+		})
+	}
+
+	results := make([]*bsky.ActorDefs_ProfileView, 0, len(dids))
+	for _, did := range dids {
+		if info, ok := actors[did]; ok {
+			results = append(results, views.ProfileView(info))
+		}
+	}
+
+	out := map[string]interface{}{
+		"actors": results,
+	}
+	if len(dids) == limit {
+		out["cursor"] = strconv.Itoa(offset + limit)
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+// HandleSearchActorsTypeahead implements app.bsky.actor.searchActorsTypeahead
+func HandleSearchActorsTypeahead(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
+	q := searchTerm(c)
+	if q == "" {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"actors": []*bsky.ActorDefs_ProfileViewBasic{},
+		})
+	}
+
+	// Parse limit
+	limit := 10
+	if limitParam := c.QueryParam("limit"); limitParam != "" {
+		if l, err := strconv.Atoi(limitParam); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	ctx := c.Request().Context()
+	viewer, _ := c.Get("viewer").(string)
+
+	var dids []string
+	if err := db.Raw(searchActorsTypeaheadQuery, searchArgs(db, q, viewer, limit, 0)).Scan(&dids).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to search actors",
+		})
+	}
+
+	actors, err := hydrator.HydrateActors(ctx, dids)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to load actors",
+		})
+	}
+
+	results := make([]*bsky.ActorDefs_ProfileViewBasic, 0, len(dids))
+	for _, did := range dids {
+		if info, ok := actors[did]; ok {
+			results = append(results, views.ProfileViewBasic(info))
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"actors": results,
+	})
+}
+
+// searchTerm returns the normalized search query. The deprecated term
+// parameter is still sent by some clients.
+func searchTerm(c echo.Context) string {
+	q := c.QueryParam("q")
+	if q == "" {
+		q = c.QueryParam("term")
+	}
+
+	// handles are stored lowercase and without the @
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(q), "@"))
+}
+
+func searchArgs(db *gorm.DB, q, viewer string, limit, offset int) map[string]interface{} {
+	var viewerID uint
+	if viewer != "" {
+		db.Raw("SELECT id FROM repos WHERE did = ?", viewer).Scan(&viewerID)
+	}
+
+	pat := escapeLike(q)
+	return map[string]interface{}{
+		"q":      q,
+		"prefix": pat + "%",
+		"word":   "% " + pat + "%",
+		"viewer": viewerID,
+		"limit":  limit,
+		"offset": offset,
+	}
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
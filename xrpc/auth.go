@@ -2,13 +2,24 @@ package xrpc
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/bluesky-social/indigo/atproto/atcrypto"
+	"github.com/bluesky-social/indigo/atproto/identity"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	lru "github.com/hashicorp/golang-lru/v2"
 	"github.com/labstack/echo/v4"
-	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/whyrusleeping/konbini/backend"
 )
 
 // requireAuth is middleware that requires authentication
@@ -18,6 +29,7 @@ func (s *Server) requireAuth(next echo.HandlerFunc) echo.HandlerFunc {
 		if err != nil {
 			return XRPCError(c, http.StatusUnauthorized, "AuthenticationRequired", err.Error())
 		}
+		s.registerViewer(c.Request().Context(), viewer)
 		c.Set("viewer", viewer)
 		return next(c)
 	}
@@ -28,14 +40,24 @@ func (s *Server) optionalAuth(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		viewer, _ := s.authenticate(c)
 		if viewer != "" {
+			s.registerViewer(c.Request().Context(), viewer)
 			c.Set("viewer", viewer)
 		}
 		return next(c)
 	}
 }
 
-// authenticate extracts and validates the JWT from the Authorization header
-// Returns the viewer DID if valid, empty string otherwise
+// registerViewer makes the viewer a local user the first time they show up,
+// if they are an account we serve
+func (s *Server) registerViewer(ctx context.Context, viewer string) {
+	if _, err := s.backend.EnsureLocalUser(ctx, viewer); err != nil && !errors.Is(err, backend.ErrUserNotAllowed) {
+		slog.Error("failed to register local user", "did", viewer, "error", err)
+	}
+}
+
+// authenticate verifies the service auth JWT from the Authorization header.
+// These are minted by the viewer's PDS when it proxies a request to us, and
+// signed with the viewer's atproto signing key. Returns the viewer DID.
 func (s *Server) authenticate(c echo.Context) (string, error) {
 	authHeader := c.Request().Header.Get("Authorization")
 	if authHeader == "" {
@@ -48,45 +70,237 @@ func (s *Server) authenticate(c echo.Context) (string, error) {
 		return "", fmt.Errorf("invalid authorization header format")
 	}
 
-	tokenString := parts[1]
+	method := strings.TrimPrefix(c.Request().URL.Path, "/xrpc/")
+
+	did, err := s.auth.verify(c.Request().Context(), parts[1], method)
+	if err != nil {
+		var aerr *serviceAuthError
+		if errors.As(err, &aerr) {
+			serviceAuthFailures.WithLabelValues(aerr.Reason).Inc()
+		}
+		return "", err
+	}
+
+	return did, nil
+}
+
+var serviceAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "service_auth_failures",
+	Help: "Number of rejected service auth tokens, by reason",
+}, []string{"reason"})
+
+type serviceAuthError struct {
+	Reason string
+	Err    error
+}
+
+func (e *serviceAuthError) Error() string {
+	return fmt.Sprintf("invalid service auth token (%s): %s", e.Reason, e.Err)
+}
+
+func (e *serviceAuthError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	// allowed clock skew between us and the PDS
+	serviceAuthLeeway = time.Second * 30
+
+	// how long a resolved signing key is trusted before resolving again
+	serviceAuthKeyTTL = time.Hour
+
+	// minimum time between forced re-resolves for the same account, so
+	// badly signed tokens can't make us resolve on every request
+	serviceAuthRefreshInterval = time.Minute
+)
+
+// serviceAuth verifies inter-service JWTs addressed to serviceDID
+type serviceAuth struct {
+	serviceDID string
+	dir        identity.Directory
+
+	keys *lru.TwoQueueCache[string, cachedSigningKey]
+
+	refreshes *lru.TwoQueueCache[string, time.Time]
+	refreshLk sync.Mutex
+}
+
+type cachedSigningKey struct {
+	key     atcrypto.PublicKey
+	fetched time.Time
+}
+
+func newServiceAuth(serviceDID string, dir identity.Directory) *serviceAuth {
+	kc, _ := lru.New2Q[string, cachedSigningKey](100_000)
+	rc, _ := lru.New2Q[string, time.Time](100_000)
+
+	return &serviceAuth{
+		serviceDID: serviceDID,
+		dir:        dir,
+		keys:       kc,
+		refreshes:  rc,
+	}
+}
+
+type serviceAuthHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+type serviceAuthClaims struct {
+	Iss string `json:"iss"`
+	Aud string `json:"aud"`
+	Exp int64  `json:"exp"`
+	Iat int64  `json:"iat"`
+	Lxm string `json:"lxm"`
+}
+
+// verify checks a service auth token for a call to the given method and
+// returns the DID of the account it was issued for.
+func (sa *serviceAuth) verify(ctx context.Context, token, method string) (string, error) {
+	if sa.serviceDID == "" {
+		return "", &serviceAuthError{Reason: "config", Err: fmt.Errorf("no service DID configured")}
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", &serviceAuthError{Reason: "format", Err: fmt.Errorf("token is not a JWT")}
+	}
+
+	var hdr serviceAuthHeader
+	if err := decodeJWTPart(parts[0], &hdr); err != nil {
+		return "", &serviceAuthError{Reason: "format", Err: err}
+	}
+
+	// access, refresh and DPoP tokens carry their own typ and are meant for
+	// the PDS, not us
+	if hdr.Typ != "" && hdr.Typ != "JWT" {
+		return "", &serviceAuthError{Reason: "typ", Err: fmt.Errorf("unexpected token type %q", hdr.Typ)}
+	}
+	if hdr.Alg != "ES256K" && hdr.Alg != "ES256" {
+		return "", &serviceAuthError{Reason: "alg", Err: fmt.Errorf("unsupported algorithm %q", hdr.Alg)}
+	}
+
+	var claims serviceAuthClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", &serviceAuthError{Reason: "format", Err: err}
+	}
+
+	if claims.Aud != sa.serviceDID && !strings.HasPrefix(claims.Aud, sa.serviceDID+"#") {
+		return "", &serviceAuthError{Reason: "aud", Err: fmt.Errorf("token is for %q", claims.Aud)}
+	}
 
-	// Parse JWT without signature validation (for development)
-	// In production, you'd want to validate the signature using the issuer's public key
-	token, err := jwt.Parse([]byte(tokenString), jwt.WithVerify(false), jwt.WithValidate(false))
+	now := time.Now()
+	if claims.Exp == 0 || now.After(time.Unix(claims.Exp, 0).Add(serviceAuthLeeway)) {
+		return "", &serviceAuthError{Reason: "exp", Err: fmt.Errorf("token has expired")}
+	}
+	if claims.Iat != 0 && time.Unix(claims.Iat, 0).After(now.Add(serviceAuthLeeway)) {
+		return "", &serviceAuthError{Reason: "iat", Err: fmt.Errorf("token was issued in the future")}
+	}
+
+	if claims.Lxm != method {
+		return "", &serviceAuthError{Reason: "lxm", Err: fmt.Errorf("token is for %q, not %q", claims.Lxm, method)}
+	}
+
+	did, err := syntax.ParseDID(claims.Iss)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse token: %w", err)
+		return "", &serviceAuthError{Reason: "iss", Err: err}
 	}
 
-	// Extract the user's DID - try both "sub" (PDS tokens) and "iss" (service tokens)
-	var userDID string
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", &serviceAuthError{Reason: "format", Err: fmt.Errorf("bad signature encoding: %w", err)}
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	key, err := sa.signingKey(ctx, did, false)
+	if err != nil {
+		return "", &serviceAuthError{Reason: "key", Err: err}
+	}
+
+	if err := checkSignature(key, hdr.Alg, signed, sig); err != nil {
+		// the account may have rotated its key since we resolved it
+		if !sa.allowRefresh(did.String()) {
+			return "", &serviceAuthError{Reason: "signature", Err: err}
+		}
+
+		key, kerr := sa.signingKey(ctx, did, true)
+		if kerr != nil {
+			return "", &serviceAuthError{Reason: "key", Err: kerr}
+		}
 
-	// First try "sub" claim (used by PDS tokens and entryway tokens)
-	sub := token.Subject()
-	if sub != "" && strings.HasPrefix(sub, "did:") {
-		userDID = sub
-	} else {
-		// Fall back to "iss" claim (used by some service tokens)
-		iss := token.Issuer()
-		if iss != "" && strings.HasPrefix(iss, "did:") {
-			userDID = iss
+		if err := checkSignature(key, hdr.Alg, signed, sig); err != nil {
+			return "", &serviceAuthError{Reason: "signature", Err: err}
 		}
 	}
 
-	if userDID == "" {
-		return "", fmt.Errorf("missing 'sub' or 'iss' claim with DID in token")
+	return did.String(), nil
+}
+
+func decodeJWTPart(part string, out any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("bad token encoding: %w", err)
+	}
+
+	return json.Unmarshal(b, out)
+}
+
+func checkSignature(key atcrypto.PublicKey, alg string, signed, sig []byte) error {
+	switch key.(type) {
+	case *atcrypto.PublicKeyK256:
+		if alg != "ES256K" {
+			return fmt.Errorf("%s token for a K-256 key", alg)
+		}
+	case *atcrypto.PublicKeyP256:
+		if alg != "ES256" {
+			return fmt.Errorf("%s token for a P-256 key", alg)
+		}
 	}
 
-	// Optional: check scope if present
-	scope, ok := token.Get("scope")
-	if ok {
-		scopeStr, _ := scope.(string)
-		// Valid scopes are: com.atproto.access, com.atproto.appPass, com.atproto.appPassPrivileged
-		if scopeStr != "com.atproto.access" && scopeStr != "com.atproto.appPass" && scopeStr != "com.atproto.appPassPrivileged" {
-			return "", fmt.Errorf("invalid token scope: %s", scopeStr)
+	return key.HashAndVerifyLenient(signed, sig)
+}
+
+// signingKey returns the atproto signing key of an account. With refresh
+// set the cached key and DID document are dropped and resolved again.
+func (sa *serviceAuth) signingKey(ctx context.Context, did syntax.DID, refresh bool) (atcrypto.PublicKey, error) {
+	if refresh {
+		sa.keys.Remove(did.String())
+		if err := sa.dir.Purge(ctx, did.AtIdentifier()); err != nil {
+			slog.Warn("failed to purge identity for key refresh", "did", did, "error", err)
 		}
+	} else if ck, ok := sa.keys.Get(did.String()); ok && time.Since(ck.fetched) < serviceAuthKeyTTL {
+		return ck.key, nil
+	}
+
+	ident, err := sa.dir.LookupDID(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", did, err)
+	}
+
+	key, err := ident.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("signing key of %s: %w", did, err)
+	}
+
+	sa.keys.Add(did.String(), cachedSigningKey{
+		key:     key,
+		fetched: time.Now(),
+	})
+
+	return key, nil
+}
+
+func (sa *serviceAuth) allowRefresh(did string) bool {
+	sa.refreshLk.Lock()
+	defer sa.refreshLk.Unlock()
+
+	if last, ok := sa.refreshes.Get(did); ok && time.Since(last) < serviceAuthRefreshInterval {
+		return false
 	}
 
-	return userDID, nil
+	sa.refreshes.Add(did, time.Now())
+	return true
 }
 
 // resolveActor resolves an actor identifier (handle or DID) to a DID
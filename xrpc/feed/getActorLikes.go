@@ -6,7 +6,6 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/whyrusleeping/konbini/hydration"
-	"github.com/whyrusleeping/konbini/views"
 	"gorm.io/gorm"
 )
 
@@ -90,21 +89,11 @@ func HandleGetActorLikes(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 	}
 
 	// Hydrate posts
-	feed := make([]interface{}, 0)
-	for _, row := range rows {
-		postInfo, err := hydrator.HydratePost(ctx, row.Subject, actorDID)
-		if err != nil {
-			continue
-		}
-
-		// Hydrate the post author
-		authorInfo, err := hydrator.HydrateActor(ctx, postInfo.Author)
-		if err != nil {
-			continue
-		}
-
-		feed = append(feed, views.FeedViewPost(postInfo, authorInfo))
+	uris := make([]string, len(rows))
+	for i, row := range rows {
+		uris[i] = row.Subject
 	}
+	feed := hydrateFeed(ctx, hydrator, actorDID, uris)
 
 	// Generate next cursor
 	var nextCursor string
@@ -5,12 +5,9 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/bluesky-social/indigo/api/bsky"
-	"github.com/bluesky-social/indigo/atproto/syntax"
 	"github.com/labstack/echo/v4"
 	"github.com/whyrusleeping/konbini/hydration"
 	"github.com/whyrusleeping/konbini/views"
@@ -20,6 +17,7 @@ import (
 type postRow struct {
 	URI      string
 	AuthorID uint
+	Created  time.Time
 }
 
 // HandleGetAuthorFeed implements app.bsky.feed.getAuthorFeed
@@ -73,7 +71,8 @@ func HandleGetAuthorFeed(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 		query = `
 			SELECT
 				'at://' || r.did || '/app.bsky.feed.post/' || p.rkey as uri,
-				p.author as author_id
+				p.author as author_id,
+				p.created
 			FROM posts p
 			JOIN repos r ON r.id = p.author
 			WHERE p.author = (SELECT id FROM repos WHERE did = ?)
@@ -87,7 +86,8 @@ func HandleGetAuthorFeed(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 		query = `
 			SELECT
 				'at://' || r.did || '/app.bsky.feed.post/' || p.rkey as uri,
-				p.author as author_id
+				p.author as author_id,
+				p.created
 			FROM posts p
 			JOIN repos r ON r.id = p.author
 			WHERE p.author = (SELECT id FROM repos WHERE did = ?)
@@ -111,14 +111,7 @@ func HandleGetAuthorFeed(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 	// Generate next cursor
 	var nextCursor string
 	if len(rows) > 0 {
-		lastURI := rows[len(rows)-1].URI
-		postInfo, err := hydrator.HydratePost(ctx, lastURI, viewer)
-		if err == nil && postInfo.Post != nil {
-			t, err := time.Parse(time.RFC3339, postInfo.Post.CreatedAt)
-			if err == nil {
-				nextCursor = t.Format(time.RFC3339)
-			}
-		}
+		nextCursor = rows[len(rows)-1].Created.Format(time.RFC3339)
 	}
 
 	return c.JSON(http.StatusOK, map[string]any{
@@ -128,80 +121,41 @@ func HandleGetAuthorFeed(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 }
 
 func hydratePostRows(ctx context.Context, hydrator *hydration.Hydrator, viewer string, rows []postRow) []*bsky.FeedDefs_FeedViewPost {
-	ctx, span := tracer.Start(ctx, "hydratePostRows")
+	uris := make([]string, len(rows))
+	for i, row := range rows {
+		uris[i] = row.URI
+	}
+
+	return hydrateFeed(ctx, hydrator, viewer, uris)
+}
+
+// hydrateFeed builds feed items for the given posts, in order, leaving out
+// the ones that couldn't be hydrated.
+func hydrateFeed(ctx context.Context, hydrator *hydration.Hydrator, viewer string, uris []string) []*bsky.FeedDefs_FeedViewPost {
+	ctx, span := tracer.Start(ctx, "hydrateFeed")
 	defer span.End()
 
-	// Hydrate posts
-	var wg sync.WaitGroup
+	feed := make([]*bsky.FeedDefs_FeedViewPost, 0, len(uris))
 
-	var outLk sync.Mutex
-	feed := make([]*bsky.FeedDefs_FeedViewPost, len(rows))
-	for i, row := range rows {
-		wg.Add(1)
-		go func(i int, row postRow) {
-			defer wg.Done()
-
-			puri, err := syntax.ParseATURI(row.URI)
-			if err != nil {
-				slog.Error("row had invalid uri", "uri", row.URI, "error", err)
-				return
-			}
-
-			var subwg sync.WaitGroup
-
-			var postInfo *hydration.PostInfo
-			subwg.Go(func() {
-				pi, err := hydrator.HydratePost(ctx, row.URI, viewer)
-				if err != nil {
-					if strings.Contains(err.Error(), "post not found") {
-						hydrator.AddMissingRecord(row.URI, true)
-						pi, err = hydrator.HydratePost(ctx, row.URI, viewer)
-						if err != nil {
-							slog.Error("failed to hydrate post after fetch missing", "uri", row.URI, "error", err)
-							return
-						}
-					} else {
-						slog.Warn("failed to hydrate post", "uri", row.URI, "error", err)
-						return
-					}
-				}
-				postInfo = pi
-			})
-
-			var authorInfo *hydration.ActorInfo
-			subwg.Go(func() {
-				ai, err := hydrator.HydrateActor(ctx, puri.Authority().String())
-				if err != nil {
-					hydrator.AddMissingRecord(postInfo.Author, false)
-					slog.Warn("failed to hydrate author", "did", postInfo.Author, "error", err)
-					return
-				}
-				authorInfo = ai
-			})
-
-			subwg.Wait()
-
-			if postInfo == nil || authorInfo == nil {
-				return
-			}
-
-			feedItem := views.FeedViewPost(postInfo, authorInfo)
-			outLk.Lock()
-			feed[i] = feedItem
-			outLk.Unlock()
-		}(i, row)
+	b, err := hydrator.HydrateBatch(ctx, uris, nil, viewer)
+	if err != nil {
+		slog.Error("failed to hydrate feed", "error", err)
+		return feed
 	}
-	wg.Wait()
 
-	x := 0
-	for i := 0; i < len(feed); i++ {
-		if feed[i] != nil {
-			feed[x] = feed[i]
-			x++
+	for _, uri := range uris {
+		postInfo, ok := b.Posts[uri]
+		if !ok {
+			continue
+		}
+
+		authorInfo, ok := b.Actors[postInfo.Author]
+		if !ok {
 			continue
 		}
+
+		feed = append(feed, views.FeedViewPost(postInfo, authorInfo))
 	}
-	feed = feed[:x]
 
 	return feed
 }
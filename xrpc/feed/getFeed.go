@@ -5,8 +5,6 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
-	"strings"
-	"sync"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/bluesky-social/indigo/atproto/identity"
@@ -14,7 +12,6 @@ import (
 	"github.com/bluesky-social/indigo/xrpc"
 	"github.com/labstack/echo/v4"
 	"github.com/whyrusleeping/konbini/hydration"
-	"github.com/whyrusleeping/konbini/views"
 	"github.com/whyrusleeping/market/models"
 	"gorm.io/gorm"
 )
@@ -151,45 +148,17 @@ func HandleGetFeed(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator, di
 	}
 
 	// Hydrate the posts from the skeleton
-	posts := make([]*bsky.FeedDefs_FeedViewPost, len(skeleton.Feed))
-	var wg sync.WaitGroup
-	for i := range skeleton.Feed {
-		wg.Add(1)
-		go func(ix int) {
-			defer wg.Done()
-			skeletonPost := skeleton.Feed[ix]
-			postURI, err := syntax.ParseATURI(skeletonPost.Post)
-			if err != nil {
-				slog.Warn("invalid post URI in skeleton", "uri", skeletonPost.Post, "error", err)
-				return
-			}
-
-			postInfo, err := hydrator.HydratePost(ctx, postURI.String(), viewer)
-			if err != nil {
-				if strings.Contains(err.Error(), "post not found") {
-					hydrator.AddMissingRecord(postURI.String(), true)
-					postInfo, err = hydrator.HydratePost(ctx, postURI.String(), viewer)
-					if err != nil {
-						slog.Error("failed to hydrate post after fetch missing", "uri", postURI, "error", err)
-						return
-					}
-				} else {
-					slog.Warn("failed to hydrate post", "uri", postURI, "error", err)
-					return
-				}
-			}
-
-			authorInfo, err := hydrator.HydrateActor(ctx, postInfo.Author)
-			if err != nil {
-				hydrator.AddMissingRecord(postInfo.Author, false)
-				slog.Warn("failed to hydrate author", "did", postInfo.Author, "error", err)
-				return
-			}
-
-			posts[ix] = views.FeedViewPost(postInfo, authorInfo)
-		}(i)
-	}
-	wg.Wait()
+	uris := make([]string, 0, len(skeleton.Feed))
+	for _, skeletonPost := range skeleton.Feed {
+		postURI, err := syntax.ParseATURI(skeletonPost.Post)
+		if err != nil {
+			slog.Warn("invalid post URI in skeleton", "uri", skeletonPost.Post, "error", err)
+			continue
+		}
+		uris = append(uris, postURI.String())
+	}
+
+	posts := hydrateFeed(ctx, hydrator, viewer, uris)
 
 	output := &bsky.FeedGetFeed_Output{
 		Feed:   posts,
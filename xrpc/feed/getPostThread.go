@@ -1,7 +1,6 @@
 package feed
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 
@@ -61,7 +60,7 @@ func HandleGetPostThread(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 		FROM posts p
 		JOIN repos r ON r.id = p.author
 		WHERE (p.id = ? OR p.in_thread = ?)
-		AND p.not_found = false
+		AND (p.not_found = false OR p.deleted)
 		ORDER BY p.created ASC
 	`, rootPostID, rootPostID).Scan(&threadPosts)
 
@@ -104,8 +103,22 @@ func HandleGetPostThread(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrat
 		})
 	}
 
-	// Build the response by traversing the tree
-	thread := buildThreadView(ctx, db, rootNode, postsByID, hydrator, viewer, nil)
+	// Hydrate the whole thread at once, then build the response by
+	// traversing the tree
+	uris := make([]string, 0, len(postsByID))
+	for _, node := range postsByID {
+		uris = append(uris, node.uri)
+	}
+
+	b, err := hydrator.HydrateBatch(ctx, uris, nil, viewer)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]any{
+			"error":   "InternalError",
+			"message": "failed to load thread",
+		})
+	}
+
+	thread := buildThreadView(rootNode, b, nil)
 
 	return c.JSON(http.StatusOK, map[string]any{
 		"thread": thread,
@@ -120,20 +133,19 @@ type threadPostNode struct {
 	replies  []any
 }
 
-func buildThreadView(ctx context.Context, db *gorm.DB, node *threadPostNode, allNodes map[uint]*threadPostNode, hydrator *hydration.Hydrator, viewer string, parent any) any {
-	// Hydrate this post
-	postInfo, err := hydrator.HydratePost(ctx, node.uri, viewer)
-	if err != nil {
-		// Return a notFound post
+func buildThreadView(node *threadPostNode, b *hydration.Batch, parent any) any {
+	postInfo, ok := b.Posts[node.uri]
+	if !ok {
+		// Return a notFound post, this is also how deleted posts show up
 		return map[string]any{
-			"$type": "app.bsky.feed.defs#notFoundPost",
-			"uri":   node.uri,
+			"$type":    "app.bsky.feed.defs#notFoundPost",
+			"uri":      node.uri,
+			"notFound": true,
 		}
 	}
 
-	// Hydrate author
-	authorInfo, err := hydrator.HydrateActor(ctx, postInfo.Author)
-	if err != nil {
+	authorInfo, ok := b.Actors[postInfo.Author]
+	if !ok {
 		return map[string]any{
 			"$type": "app.bsky.feed.defs#notFoundPost",
 			"uri":   node.uri,
@@ -144,7 +156,7 @@ func buildThreadView(ctx context.Context, db *gorm.DB, node *threadPostNode, all
 	var replies []any
 	for _, replyNode := range node.replies {
 		if rn, ok := replyNode.(*threadPostNode); ok {
-			replyView := buildThreadView(ctx, db, rn, allNodes, hydrator, viewer, nil)
+			replyView := buildThreadView(rn, b, nil)
 			replies = append(replies, replyView)
 		}
 	}
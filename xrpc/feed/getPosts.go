@@ -41,7 +41,7 @@ func HandleGetPosts(c echo.Context, hydrator *hydration.Hydrator) error {
 	viewer := getUserDID(c)
 
 	// Hydrate posts
-	postsMap, err := hydrator.HydratePosts(ctx, uris, viewer)
+	b, err := hydrator.HydrateBatch(ctx, uris, nil, viewer)
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
 			"error":   "InternalError",
@@ -52,15 +52,14 @@ func HandleGetPosts(c echo.Context, hydrator *hydration.Hydrator) error {
 	// Build response - need to maintain order of requested URIs
 	posts := make([]interface{}, 0)
 	for _, uri := range uris {
-		postInfo, ok := postsMap[uri]
+		postInfo, ok := b.Posts[uri]
 		if !ok {
 			// Post not found, skip it
 			continue
 		}
 
-		// Hydrate author
-		authorInfo, err := hydrator.HydrateActor(ctx, postInfo.Author)
-		if err != nil {
+		authorInfo, ok := b.Actors[postInfo.Author]
+		if !ok {
 			continue
 		}
 
@@ -69,17 +69,7 @@ func HandleGetTimeline(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator
 	// Generate next cursor
 	var nextCursor string
 	if len(rows) > 0 {
-		// Get the created time of the last post
-		var lastCreated time.Time
-		lastURI := rows[len(rows)-1].URI
-		postInfo, err := hydrator.HydratePost(ctx, lastURI, viewer)
-		if err == nil && postInfo.Post != nil {
-			t, err := time.Parse(time.RFC3339, postInfo.Post.CreatedAt)
-			if err == nil {
-				lastCreated = t
-				nextCursor = lastCreated.Format(time.RFC3339)
-			}
-		}
+		nextCursor = rows[len(rows)-1].Created.Format(time.RFC3339)
 	}
 
 	return c.JSON(http.StatusOK, map[string]any{
@@ -96,7 +86,8 @@ func getTimelinePosts(ctx context.Context, db *gorm.DB, uid uint, cursor time.Ti
 	err := db.Raw(`
 		SELECT
 			'at://' || r.did || '/app.bsky.feed.post/' || p.rkey as uri,
-			p.author as author_id
+			p.author as author_id,
+			p.created
 		FROM posts p
 		JOIN repos r ON r.id = p.author
 		WHERE p.reply_to = 0
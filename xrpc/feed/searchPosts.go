@@ -0,0 +1,380 @@
+package feed
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/labstack/echo/v4"
+	"github.com/whyrusleeping/konbini/backend"
+	"github.com/whyrusleeping/konbini/hydration"
+	"github.com/whyrusleeping/konbini/views"
+	"gorm.io/gorm"
+)
+
+// postSearch is a parsed searchPosts request. The filters come from the
+// query parameters, and from operators like from: and lang: in the query
+// itself, which take precedence.
+type postSearch struct {
+	text     []string
+	author   string
+	mentions string
+	lang     string
+	domain   string
+	url      string
+	tags     []string
+	since    time.Time
+	until    time.Time
+}
+
+// HandleSearchPosts implements app.bsky.feed.searchPosts
+func HandleSearchPosts(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
+	q := strings.TrimSpace(c.QueryParam("q"))
+	if q == "" {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "InvalidRequest",
+			"message": "q parameter is required",
+		})
+	}
+
+	// Parse limit
+	limit := 25
+	if limitParam := c.QueryParam("limit"); limitParam != "" {
+		if l, err := strconv.Atoi(limitParam); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	sort := c.QueryParam("sort")
+	if sort != "top" {
+		sort = "latest"
+	}
+
+	ctx := c.Request().Context()
+	viewer := getUserDID(c)
+
+	s := postSearch{
+		author:   c.QueryParam("author"),
+		mentions: c.QueryParam("mentions"),
+		lang:     c.QueryParam("lang"),
+		domain:   c.QueryParam("domain"),
+		url:      c.QueryParam("url"),
+		tags:     c.QueryParams()["tag"],
+	}
+	if t, ok := parseSearchTime(c.QueryParam("since")); ok {
+		s.since = t
+	}
+	if t, ok := parseSearchTime(c.QueryParam("until")); ok {
+		s.until = t
+	}
+
+	s.parseQuery(q)
+
+	empty := map[string]interface{}{
+		"posts": []interface{}{},
+	}
+
+	// from:me and friends refer to the viewer
+	for _, ident := range []*string{&s.author, &s.mentions} {
+		if *ident == "" {
+			continue
+		}
+
+		if *ident == "me" {
+			if viewer == "" {
+				return c.JSON(http.StatusOK, empty)
+			}
+			*ident = viewer
+			continue
+		}
+
+		did, err := hydrator.ResolveDID(ctx, strings.TrimPrefix(*ident, "@"))
+		if err != nil {
+			// nobody can have posted from or to an account that doesn't exist
+			return c.JSON(http.StatusOK, empty)
+		}
+		*ident = did
+	}
+
+	query, args := s.sql()
+	if query == "" {
+		return c.JSON(http.StatusOK, empty)
+	}
+
+	type searchRow struct {
+		Post    uint
+		Did     string
+		Rkey    string
+		Created time.Time
+	}
+	var rows []searchRow
+
+	var nextCursor string
+	if sort == "top" {
+		// top results are ranked, so the cursor is an offset into them.
+		// Engagement counts for more the newer a post is, and posts that
+		// match the text better are boosted.
+		offset := 0
+		if cursorParam := c.QueryParam("cursor"); cursorParam != "" {
+			if o, err := strconv.Atoi(cursorParam); err == nil && o > 0 {
+				offset = o
+			}
+		}
+
+		rank := "1"
+		if len(s.text) > 0 {
+			rank = "1 + ts_rank(to_tsvector('simple', ps.text), websearch_to_tsquery('simple', ?))"
+			args = append(args, strings.Join(s.text, " "))
+		}
+
+		query += `
+ORDER BY (1 + COALESCE(pc.likes, 0) + 2 * COALESCE(pc.reposts, 0) + COALESCE(pc.replies, 0) + COALESCE(pc.quotes, 0))
+	* (` + rank + `)
+	/ power(EXTRACT(EPOCH FROM NOW() - ps.created) / 3600 + 2, 1.5) DESC, ps.post DESC
+LIMIT ? OFFSET ?`
+		args = append(args, limit, offset)
+
+		if err := db.Raw(query, args...).Scan(&rows).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+				"error":   "InternalError",
+				"message": "failed to search posts",
+			})
+		}
+
+		if len(rows) == limit {
+			nextCursor = strconv.Itoa(offset + limit)
+		}
+	} else {
+		// Parse cursor (created timestamp and post ID of the last result)
+		if cursorParam := c.QueryParam("cursor"); cursorParam != "" {
+			if ts, id, ok := parseLatestCursor(cursorParam); ok {
+				query += ` AND (ps.created, ps.post) < (?, ?)`
+				args = append(args, ts, id)
+			}
+		}
+
+		query += ` ORDER BY ps.created DESC, ps.post DESC LIMIT ?`
+		args = append(args, limit)
+
+		if err := db.Raw(query, args...).Scan(&rows).Error; err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+				"error":   "InternalError",
+				"message": "failed to search posts",
+			})
+		}
+
+		if len(rows) == limit {
+			last := rows[len(rows)-1]
+			nextCursor = fmt.Sprintf("%d:%d", last.Created.UnixMicro(), last.Post)
+		}
+	}
+
+	uris := make([]string, 0, len(rows))
+	for _, row := range rows {
+		uris = append(uris, "at://"+row.Did+"/app.bsky.feed.post/"+row.Rkey)
+	}
+
+	b, err := hydrator.HydrateBatch(ctx, uris, nil, viewer)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to load posts",
+		})
+	}
+
+	posts := make([]interface{}, 0, len(uris))
+	for _, uri := range uris {
+		postInfo, ok := b.Posts[uri]
+		if !ok {
+			continue
+		}
+
+		authorInfo, ok := b.Actors[postInfo.Author]
+		if !ok {
+			continue
+		}
+
+		posts = append(posts, views.PostView(postInfo, authorInfo))
+	}
+
+	out := map[string]interface{}{
+		"posts": posts,
+	}
+	if nextCursor != "" {
+		out["cursor"] = nextCursor
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
+
+// parseQuery pulls the operators out of a search query, leaving the rest as
+// the text to search for. Quoted phrases and -negated words are handled by
+// websearch_to_tsquery.
+func (s *postSearch) parseQuery(q string) {
+	for _, tok := range splitSearchQuery(q) {
+		if strings.HasPrefix(tok, "#") && len(tok) > 1 {
+			s.tags = append(s.tags, tok)
+			continue
+		}
+
+		op, val, ok := strings.Cut(tok, ":")
+		if !ok || val == "" {
+			s.text = append(s.text, tok)
+			continue
+		}
+
+		switch strings.ToLower(op) {
+		case "from":
+			s.author = val
+		case "to", "mentions":
+			s.mentions = val
+		case "lang":
+			s.lang = val
+		case "domain":
+			s.domain = val
+		case "url":
+			s.url = val
+		case "tag":
+			s.tags = append(s.tags, val)
+		case "since":
+			if t, ok := parseSearchTime(val); ok {
+				s.since = t
+			}
+		case "until":
+			if t, ok := parseSearchTime(val); ok {
+				s.until = t
+			}
+		default:
+			s.text = append(s.text, tok)
+		}
+	}
+}
+
+// sql builds the search query without its ORDER BY and LIMIT, or returns an
+// empty query if there is nothing to search for.
+func (s *postSearch) sql() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if len(s.text) > 0 {
+		conds = append(conds, "to_tsvector('simple', ps.text) @@ websearch_to_tsquery('simple', ?)")
+		args = append(args, strings.Join(s.text, " "))
+	}
+
+	if s.author != "" {
+		conds = append(conds, "ps.author = (SELECT id FROM repos WHERE did = ?)")
+		args = append(args, s.author)
+	}
+
+	contains := func(col, val string) {
+		if val == "" {
+			return
+		}
+		conds = append(conds, "ps."+col+" @> ARRAY[?]::text[]")
+		args = append(args, val)
+	}
+
+	contains("mentions", s.mentions)
+	contains("langs", backend.NormalizeSearchLang(s.lang))
+	contains("domains", backend.NormalizeSearchDomain(s.domain))
+	contains("urls", backend.NormalizeSearchURL(s.url))
+	for _, t := range s.tags {
+		contains("tags", backend.NormalizeSearchTag(t))
+	}
+
+	// filters on their own would list every post, so there has to be at
+	// least one of them besides the time range
+	if len(conds) == 0 {
+		return "", nil
+	}
+
+	if !s.since.IsZero() {
+		conds = append(conds, "ps.created >= ?")
+		args = append(args, s.since)
+	}
+	if !s.until.IsZero() {
+		conds = append(conds, "ps.created < ?")
+		args = append(args, s.until)
+	}
+
+	query := `
+SELECT ps.post, r.did, p.rkey, ps.created
+FROM post_searches ps
+JOIN posts p ON p.id = ps.post
+JOIN repos r ON r.id = ps.author
+LEFT JOIN post_counts pc ON pc.post = ps.post
+WHERE ` + strings.Join(conds, " AND ") + `
+AND NOT EXISTS (SELECT 1 FROM account_statuses a WHERE a.repo = ps.author)`
+
+	return query, args
+}
+
+// splitSearchQuery splits a query on whitespace, keeping quoted phrases
+// together.
+func splitSearchQuery(q string) []string {
+	var out []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			cur.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+			}
+		default:
+			cur.WriteRune(r)
+		}
+	}
+
+	if cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+
+	return out
+}
+
+// parseSearchTime parses since and until values, which can be datetimes or
+// plain dates.
+func parseSearchTime(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, true
+	}
+
+	t, err := syntax.ParseDatetimeLenient(s)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t.Time(), true
+}
+
+func parseLatestCursor(cursor string) (time.Time, uint, bool) {
+	ts, id, ok := strings.Cut(cursor, ":")
+	if !ok {
+		return time.Time{}, 0, false
+	}
+
+	us, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	pid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+
+	return time.UnixMicro(us), uint(pid), true
+}
@@ -270,6 +270,8 @@ func mapNotifKind(kind string) string {
 		return "repost"
 	case "mention":
 		return "mention"
+	case "quote":
+		return "quote"
 	case "follow":
 		return "follow"
 	default:
@@ -1,17 +1,34 @@
 package repo
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 
 	cbg "github.com/whyrusleeping/cbor-gen"
 
+	"github.com/bluesky-social/indigo/atproto/atdata"
 	lexutil "github.com/bluesky-social/indigo/lex/util"
 	"github.com/labstack/echo/v4"
 	"github.com/whyrusleeping/konbini/hydration"
+	"github.com/whyrusleeping/konbini/models"
 	"gorm.io/gorm"
 )
 
+// decodeRecord decodes a raw record for a JSON response. Types we have
+// lexicon bindings for go through them, anything else is decoded generically.
+func decodeRecord(raw []byte) (any, error) {
+	rec, err := lexutil.CborDecodeValue(raw)
+	if err == nil {
+		return rec, nil
+	}
+	if !errors.Is(err, lexutil.ErrUnrecognizedType) {
+		return nil, err
+	}
+
+	return atdata.UnmarshalCBOR(raw)
+}
+
 // HandleGetRecord implements com.atproto.repo.getRecord
 func HandleGetRecord(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
 	repoParam := c.QueryParam("repo")
@@ -152,10 +169,22 @@ func HandleGetRecord(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator)
 		recordRaw = repost.Raw
 
 	default:
-		return c.JSON(http.StatusBadRequest, map[string]interface{}{
-			"error":   "InvalidRequest",
-			"message": fmt.Sprintf("unsupported collection: %s", collection),
-		})
+		// collections we don't model may be in the generic records table
+		var rec models.Record
+		err = db.Raw(`
+			SELECT rc.*
+			FROM records rc
+			JOIN repos r ON r.id = rc.author
+			WHERE r.did = ? AND rc.collection = ? AND rc.rkey = ?
+		`, repoDID, collection, rkey).Scan(&rec).Error
+		if err != nil || rec.ID == 0 {
+			return c.JSON(http.StatusNotFound, map[string]interface{}{
+				"error":   "RecordNotFound",
+				"message": fmt.Sprintf("could not locate record: %s", uri),
+			})
+		}
+		recordCID = rec.Cid
+		recordRaw = rec.Raw
 	}
 
 	// Check CID if provided
@@ -171,7 +200,7 @@ func HandleGetRecord(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator)
 	// type-specific unmarshalers for each collection type
 	var value interface{}
 	if len(recordRaw) > 0 {
-		rec, err := lexutil.CborDecodeValue(recordRaw)
+		rec, err := decodeRecord(recordRaw)
 		if err != nil {
 			return err
 		}
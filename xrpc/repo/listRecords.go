@@ -0,0 +1,101 @@
+package repo
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/whyrusleeping/konbini/hydration"
+	"github.com/whyrusleeping/konbini/models"
+	"gorm.io/gorm"
+)
+
+// HandleListRecords implements com.atproto.repo.listRecords
+// Only collections kept in the generic records table are served, the ones we
+// model ourselves are better fetched from the appview endpoints or the PDS.
+func HandleListRecords(c echo.Context, db *gorm.DB, hydrator *hydration.Hydrator) error {
+	repoParam := c.QueryParam("repo")
+	collection := c.QueryParam("collection")
+
+	if repoParam == "" || collection == "" {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "InvalidRequest",
+			"message": "repo and collection parameters are required",
+		})
+	}
+
+	limit := 50
+	if limitParam := c.QueryParam("limit"); limitParam != "" {
+		if l, err := strconv.Atoi(limitParam); err == nil && l > 0 && l <= 100 {
+			limit = l
+		}
+	}
+
+	cursor := c.QueryParam("cursor")
+	reverse := c.QueryParam("reverse") == "true"
+
+	ctx := c.Request().Context()
+
+	repoDID, err := hydrator.ResolveDID(ctx, repoParam)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{
+			"error":   "InvalidRequest",
+			"message": fmt.Sprintf("could not find repo: %s", repoParam),
+		})
+	}
+
+	// records are listed newest first by default, like a PDS does
+	query := `
+		SELECT rc.*
+		FROM records rc
+		JOIN repos r ON r.id = rc.author
+		WHERE r.did = ? AND rc.collection = ?
+	`
+	args := []any{repoDID, collection}
+	if cursor != "" {
+		if reverse {
+			query += ` AND rc.rkey > ?`
+		} else {
+			query += ` AND rc.rkey < ?`
+		}
+		args = append(args, cursor)
+	}
+	if reverse {
+		query += ` ORDER BY rc.rkey ASC LIMIT ?`
+	} else {
+		query += ` ORDER BY rc.rkey DESC LIMIT ?`
+	}
+	args = append(args, limit)
+
+	var rows []models.Record
+	if err := db.Raw(query, args...).Scan(&rows).Error; err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":   "InternalError",
+			"message": "failed to list records",
+		})
+	}
+
+	records := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		value, err := decodeRecord(row.Raw)
+		if err != nil {
+			continue
+		}
+
+		records = append(records, map[string]interface{}{
+			"uri":   fmt.Sprintf("at://%s/%s/%s", repoDID, collection, row.Rkey),
+			"cid":   row.Cid,
+			"value": value,
+		})
+	}
+
+	out := map[string]interface{}{
+		"records": records,
+	}
+	if len(rows) == limit {
+		out["cursor"] = rows[len(rows)-1].Rkey
+	}
+
+	return c.JSON(http.StatusOK, out)
+}
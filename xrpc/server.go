@@ -28,6 +28,7 @@ type Server struct {
 	dir      identity.Directory
 	backend  Backend
 	hydrator *hydration.Hydrator
+	auth     *serviceAuth
 }
 
 // Backend interface for data access
@@ -36,10 +37,13 @@ type Backend interface {
 
 	TrackMissingRecord(identifier string, wait bool)
 	GetOrCreateRepo(ctx context.Context, did string) (*models.Repo, error)
+	EnsureLocalUser(ctx context.Context, did string) (*models.LocalUser, error)
+	TrendingTags() *backend.TrendingTags
 }
 
-// NewServer creates a new XRPC server
-func NewServer(db *gorm.DB, dir identity.Directory, backend *backend.PostgresBackend) *Server {
+// NewServer creates a new XRPC server. Requests are authenticated with
+// service auth tokens addressed to serviceDID.
+func NewServer(db *gorm.DB, dir identity.Directory, backend *backend.PostgresBackend, serviceDID string) *Server {
 	e := echo.New()
 	e.HidePort = true
 	e.HideBanner = true
@@ -61,6 +65,7 @@ func NewServer(db *gorm.DB, dir identity.Directory, backend *backend.PostgresBac
 		dir:      dir,
 		backend:  backend,
 		hydrator: hydration.NewHydrator(db, dir, backend),
+		auth:     newServiceAuth(serviceDID, dir),
 	}
 
 	// Register XRPC endpoints
@@ -92,6 +97,9 @@ func (s *Server) registerEndpoints() {
 	xrpcGroup.GET("/com.atproto.repo.getRecord", func(c echo.Context) error {
 		return repo.HandleGetRecord(c, s.db, s.hydrator)
 	})
+	xrpcGroup.GET("/com.atproto.repo.listRecords", func(c echo.Context) error {
+		return repo.HandleListRecords(c, s.db, s.hydrator)
+	})
 
 	// app.bsky.actor.*
 	xrpcGroup.GET("/app.bsky.actor.getProfile", func(c echo.Context) error {
@@ -106,8 +114,12 @@ func (s *Server) registerEndpoints() {
 	xrpcGroup.POST("/app.bsky.actor.putPreferences", func(c echo.Context) error {
 		return actor.HandlePutPreferences(c, s.db, s.hydrator)
 	}, s.requireAuth)
-	xrpcGroup.GET("/app.bsky.actor.searchActors", s.handleSearchActors)
-	xrpcGroup.GET("/app.bsky.actor.searchActorsTypeahead", s.handleSearchActorsTypeahead)
+	xrpcGroup.GET("/app.bsky.actor.searchActors", func(c echo.Context) error {
+		return actor.HandleSearchActors(c, s.db, s.hydrator)
+	}, s.optionalAuth)
+	xrpcGroup.GET("/app.bsky.actor.searchActorsTypeahead", func(c echo.Context) error {
+		return actor.HandleSearchActorsTypeahead(c, s.db, s.hydrator)
+	}, s.optionalAuth)
 
 	// app.bsky.feed.*
 	xrpcGroup.GET("/app.bsky.feed.getTimeline", func(c echo.Context) error {
@@ -137,6 +149,9 @@ func (s *Server) registerEndpoints() {
 	xrpcGroup.GET("/app.bsky.feed.getFeedGenerator", func(c echo.Context) error {
 		return feed.HandleGetFeedGenerator(c, s.db, s.hydrator, s.dir)
 	})
+	xrpcGroup.GET("/app.bsky.feed.searchPosts", func(c echo.Context) error {
+		return feed.HandleSearchPosts(c, s.db, s.hydrator)
+	}, s.optionalAuth)
 
 	// app.bsky.graph.*
 	xrpcGroup.GET("/app.bsky.graph.getFollows", func(c echo.Context) error {
@@ -178,7 +193,7 @@ func (s *Server) registerEndpoints() {
 		return unspecced.HandleGetConfig(c)
 	})
 	xrpcGroup.GET("/app.bsky.unspecced.getTrendingTopics", func(c echo.Context) error {
-		return unspecced.HandleGetTrendingTopics(c)
+		return unspecced.HandleGetTrendingTopics(c, s.backend.TrendingTags())
 	})
 	xrpcGroup.GET("/app.bsky.unspecced.getPostThreadV2", func(c echo.Context) error {
 		return unspecced.HandleGetPostThreadV2(c, s.db, s.hydrator)
@@ -206,14 +221,6 @@ func getUserDID(c echo.Context) string {
 	return ""
 }
 
-func (s *Server) handleSearchActors(c echo.Context) error {
-	return XRPCError(c, http.StatusNotImplemented, "NotImplemented", "Not yet implemented")
-}
-
-func (s *Server) handleSearchActorsTypeahead(c echo.Context) error {
-	return XRPCError(c, http.StatusNotImplemented, "NotImplemented", "Not yet implemented")
-}
-
 func (s *Server) handleGetLists(c echo.Context) error {
 	return XRPCError(c, http.StatusNotImplemented, "NotImplemented", "Not yet implemented")
 }
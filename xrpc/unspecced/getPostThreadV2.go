@@ -7,7 +7,6 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
-	"sync"
 
 	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/labstack/echo/v4"
@@ -95,6 +94,19 @@ func HandleGetPostThreadV2(c echo.Context, db *gorm.DB, hydrator *hydration.Hydr
 
 	anchor := treeNodes[anchorPostInfo.ID]
 
+	// Hydrate every post in the thread at once
+	var uris []string
+	for _, node := range treeNodes {
+		if !node.missing && len(node.val.Raw) > 0 {
+			uris = append(uris, node.uri)
+		}
+	}
+
+	b, err := hydrator.HydrateBatch(ctx, uris, nil, viewer)
+	if err != nil {
+		return fmt.Errorf("failed to hydrate thread: %w", err)
+	}
+
 	// Build flat thread items list
 	var threadItems []*bsky.UnspeccedGetPostThreadV2_ThreadItem
 	hasOtherReplies := false
@@ -120,7 +132,7 @@ func HandleGetPostThreadV2(c echo.Context, db *gorm.DB, hydrator *hydration.Hydr
 				break
 			}
 
-			item := buildThreadItem(ctx, hydrator, parent, depth, viewer)
+			item := buildThreadItem(b, parent, depth)
 			if item != nil {
 				threadItems = append(threadItems, item)
 			}
@@ -131,17 +143,14 @@ func HandleGetPostThreadV2(c echo.Context, db *gorm.DB, hydrator *hydration.Hydr
 	}
 
 	// Add anchor post (depth 0)
-	anchorItem := buildThreadItem(ctx, hydrator, anchor, 0, viewer)
+	anchorItem := buildThreadItem(b, anchor, 0)
 	if anchorItem != nil {
 		threadItems = append(threadItems, anchorItem)
 	}
 
 	// Add replies below anchor
 	if below > 0 {
-		replies, err := collectReplies(ctx, hydrator, anchor, 0, below, branchingFactor, sort, viewer)
-		if err != nil {
-			return err
-		}
+		replies := collectReplies(b, anchor, 0, below, branchingFactor, sort)
 		threadItems = append(threadItems, replies...)
 		//hasOtherReplies = hasMore
 	}
@@ -152,52 +161,28 @@ func HandleGetPostThreadV2(c echo.Context, db *gorm.DB, hydrator *hydration.Hydr
 	})
 }
 
-func collectReplies(ctx context.Context, hydrator *hydration.Hydrator, curnode *threadTree, depth int64, below int64, branchingFactor int64, sort string, viewer string) ([]*bsky.UnspeccedGetPostThreadV2_ThreadItem, error) {
+func collectReplies(b *hydration.Batch, curnode *threadTree, depth int64, below int64, branchingFactor int64, sort string) []*bsky.UnspeccedGetPostThreadV2_ThreadItem {
 	if below == 0 {
-		return nil, nil
-	}
-
-	type parThreadResults struct {
-		node     *bsky.UnspeccedGetPostThreadV2_ThreadItem
-		children []*bsky.UnspeccedGetPostThreadV2_ThreadItem
+		return nil
 	}
 
-	results := make([]parThreadResults, len(curnode.children))
-
-	var wg sync.WaitGroup
-	for i := range curnode.children {
-		ix := i
-		wg.Go(func() {
-			child := curnode.children[ix]
-
-			results[ix].node = buildThreadItem(ctx, hydrator, child, depth+1, viewer)
-			if child.missing {
-				return
-			}
-
-			sub, err := collectReplies(ctx, hydrator, child, depth+1, below-1, branchingFactor, sort, viewer)
-			if err != nil {
-				slog.Error("failed to collect replies", "node", child.uri, "error", err)
-				return
-			}
-
-			results[ix].children = sub
-		})
-	}
-
-	wg.Wait()
-
 	var out []*bsky.UnspeccedGetPostThreadV2_ThreadItem
-	for _, res := range results {
-		out = append(out, res.node)
-		out = append(out, res.children...)
+	for _, child := range curnode.children {
+		out = append(out, buildThreadItem(b, child, depth+1))
+		if child.missing {
+			continue
+		}
+
+		out = append(out, collectReplies(b, child, depth+1, below-1, branchingFactor, sort)...)
 	}
 
-	return out, nil
+	return out
 }
 
-func buildThreadItem(ctx context.Context, hydrator *hydration.Hydrator, node *threadTree, depth int64, viewer string) *bsky.UnspeccedGetPostThreadV2_ThreadItem {
-	if node.missing {
+func buildThreadItem(b *hydration.Batch, node *threadTree, depth int64) *bsky.UnspeccedGetPostThreadV2_ThreadItem {
+	// deleted posts that still have replies are kept as tombstones, show a
+	// placeholder for them so the replies stay attached
+	if node.missing || (node.val != nil && node.val.NotFound && len(node.val.Raw) == 0) {
 		return &bsky.UnspeccedGetPostThreadV2_ThreadItem{
 			Depth: depth,
 			Uri:   node.uri,
@@ -209,10 +194,9 @@ func buildThreadItem(ctx context.Context, hydrator *hydration.Hydrator, node *th
 		}
 	}
 
-	// Hydrate the post
-	postInfo, err := hydrator.HydratePostDB(ctx, node.uri, node.val, viewer)
-	if err != nil {
-		slog.Error("failed to hydrate post in thread item", "uri", node.uri, "error", err)
+	postInfo, ok := b.Posts[node.uri]
+	if !ok {
+		slog.Error("failed to hydrate post in thread item", "uri", node.uri)
 		// Return not found item
 		return &bsky.UnspeccedGetPostThreadV2_ThreadItem{
 			Depth: depth,
@@ -225,10 +209,9 @@ func buildThreadItem(ctx context.Context, hydrator *hydration.Hydrator, node *th
 		}
 	}
 
-	// Hydrate author
-	authorInfo, err := hydrator.HydrateActor(ctx, postInfo.Author)
-	if err != nil {
-		slog.Error("failed to hydrate actor in thread item", "author", postInfo.Author, "error", err)
+	authorInfo, ok := b.Actors[postInfo.Author]
+	if !ok {
+		slog.Error("failed to hydrate actor in thread item", "author", postInfo.Author)
 		return &bsky.UnspeccedGetPostThreadV2_ThreadItem{
 			Depth: depth,
 			Uri:   node.uri,
@@ -328,6 +311,11 @@ func buildThreadTree(ctx context.Context, hydrator *hydration.Hydrator, db *gorm
 
 		pnode, ok := nodes[node.val.ReplyTo]
 		if !ok {
+			// a deleted post doesn't tell us who its parent was
+			if len(node.val.Raw) == 0 {
+				continue
+			}
+
 			pnode = &threadTree{
 				missing: true,
 			}
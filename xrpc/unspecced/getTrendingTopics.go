@@ -2,15 +2,64 @@ package unspecced
 
 import (
 	"net/http"
+	"net/url"
+	"strconv"
 
+	"github.com/bluesky-social/indigo/api/bsky"
 	"github.com/labstack/echo/v4"
+	"github.com/whyrusleeping/konbini/backend"
 )
 
 // HandleGetTrendingTopics implements app.bsky.unspecced.getTrendingTopics
-// Returns trending topics (empty for now)
-func HandleGetTrendingTopics(c echo.Context) error {
+// Returns the hashtags trending in the posts we index, and the ones that are
+// popular over a longer period as suggestions
+func HandleGetTrendingTopics(c echo.Context, trending *backend.TrendingTags) error {
+	// Parse limit
+	limit := 10
+	if limitParam := c.QueryParam("limit"); limitParam != "" {
+		if l, err := strconv.Atoi(limitParam); err == nil && l > 0 && l <= 25 {
+			limit = l
+		}
+	}
+
+	topics := make([]*bsky.UnspeccedDefs_TrendingTopic, 0, limit)
+	suggested := make([]*bsky.UnspeccedDefs_TrendingTopic, 0, limit)
+
+	// not computed yet
+	if trending == nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"topics":    topics,
+			"suggested": suggested,
+		})
+	}
+
+	for _, t := range trending.Topics {
+		if len(topics) == limit {
+			break
+		}
+		topics = append(topics, tagTopic(t.Tag))
+	}
+
+	for _, t := range trending.Suggested {
+		if len(suggested) == limit {
+			break
+		}
+		suggested = append(suggested, tagTopic(t.Tag))
+	}
+
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"topics":    []interface{}{},
-		"suggested": []interface{}{},
+		"topics":    topics,
+		"suggested": suggested,
 	})
 }
+
+// tagTopic builds a topic that links to the app's hashtag page, which lists
+// the tag's posts through searchPosts
+func tagTopic(tag string) *bsky.UnspeccedDefs_TrendingTopic {
+	display := "#" + tag
+	return &bsky.UnspeccedDefs_TrendingTopic{
+		Topic:       tag,
+		DisplayName: &display,
+		Link:        "/hashtag/" + url.PathEscape(tag),
+	}
+}